@@ -23,26 +23,24 @@ func NewEncryptor() (*Encryptor, error) {
 	}, nil
 }
 
+// EncryptChunk encrypts data of any size for this encryptor's own key
+// using envelope encryption (see Seal).
 func (e *Encryptor) EncryptChunk(data []byte) ([]byte, error) {
-	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, e.publicKey, data, nil)
-	if err != nil {
-		return nil, fmt.Errorf("encryption error: %w", err)
-	}
-	return ciphertext, nil
+	return Seal(e.publicKey, data)
 }
 
 func (e *Encryptor) DecryptChunk(data []byte) ([]byte, error) {
-	plaintext, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privateKey, data, nil)
-	if err != nil {
-		return nil, fmt.Errorf("decryption error: %w", err)
-	}
-	return plaintext, nil
+	return e.Open(data)
 }
 
 func (e *Encryptor) GetPrivateKey() *rsa.PrivateKey {
 	return e.privateKey
 }
 
+func (e *Encryptor) GetPublicKey() *rsa.PublicKey {
+	return e.publicKey
+}
+
 func ComputeHash(data []byte) []byte {
 	hasher := sha256.New()
 	hasher.Write(data)
@@ -1,6 +1,10 @@
 package crypto
 
 import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -35,3 +39,127 @@ func TestComputeHash(t *testing.T) {
 		t.Errorf("Hash is empty")
 	}
 }
+
+func TestEncryptDecryptLargeChunk(t *testing.T) {
+	encryptor, err := NewEncryptor()
+	if err != nil {
+		t.Fatalf("Failed to create encryptor: %v", err)
+	}
+
+	originalData := bytes.Repeat([]byte("chunk"), 1024*1024/5+1)
+	encryptedData, err := encryptor.EncryptChunk(originalData)
+	if err != nil {
+		t.Fatalf("Failed to encrypt chunk: %v", err)
+	}
+
+	decryptedData, err := encryptor.DecryptChunk(encryptedData)
+	if err != nil {
+		t.Fatalf("Failed to decrypt chunk: %v", err)
+	}
+	if !bytes.Equal(decryptedData, originalData) {
+		t.Errorf("Decrypted data does not match original data")
+	}
+
+	encryptedData[len(encryptedData)-1] ^= 0x01
+	if _, err := encryptor.DecryptChunk(encryptedData); err == nil {
+		t.Errorf("Expected tampered ciphertext to be rejected")
+	}
+}
+
+func TestWrapKeyForRecipient(t *testing.T) {
+	recipient, err := NewEncryptor()
+	if err != nil {
+		t.Fatalf("Failed to create encryptor: %v", err)
+	}
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	wrapped, err := WrapKey(recipient.GetPublicKey(), key)
+	if err != nil {
+		t.Fatalf("Failed to wrap key: %v", err)
+	}
+	unwrapped, err := recipient.UnwrapKey(wrapped)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Errorf("Unwrapped key does not match")
+	}
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	for _, size := range []int{0, 1, StreamSegmentSize, StreamSegmentSize + 1, 3*StreamSegmentSize + 17} {
+		plaintext := bytes.Repeat([]byte{0x5a}, size)
+
+		var encrypted bytes.Buffer
+		if err := EncryptStream(&encrypted, bytes.NewReader(plaintext), key); err != nil {
+			t.Fatalf("Failed to encrypt %d byte stream: %v", size, err)
+		}
+
+		var decrypted bytes.Buffer
+		if err := DecryptStream(&decrypted, bytes.NewReader(encrypted.Bytes()), key); err != nil {
+			t.Fatalf("Failed to decrypt %d byte stream: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("Decrypted %d byte stream does not match", size)
+		}
+	}
+}
+
+func TestDecryptStreamDetectsTruncation(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	plaintext := bytes.Repeat([]byte{0x5a}, 2*StreamSegmentSize+1)
+
+	var encrypted bytes.Buffer
+	if err := EncryptStream(&encrypted, bytes.NewReader(plaintext), key); err != nil {
+		t.Fatalf("Failed to encrypt stream: %v", err)
+	}
+
+	// Drop the final segment: everything decrypts, but the stream never ends.
+	segment := 5 + StreamSegmentSize + 16
+	truncated := encrypted.Bytes()[:16+2*segment]
+	if err := DecryptStream(io.Discard, bytes.NewReader(truncated), key); err == nil {
+		t.Errorf("Expected truncated stream to be rejected")
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "identity.pem")
+
+	created, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Identity file was not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected identity file mode 0600, got %o", info.Mode().Perm())
+	}
+
+	loaded, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to load identity: %v", err)
+	}
+	if !bytes.Equal(created.PublicKey(), loaded.PublicKey()) {
+		t.Errorf("Reloaded identity has a different public key")
+	}
+
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Failed to overwrite identity: %v", err)
+	}
+	if _, err := LoadOrCreateIdentity(path); err == nil {
+		t.Errorf("Expected an error for an invalid identity file")
+	}
+}
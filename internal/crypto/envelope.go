@@ -0,0 +1,172 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	KeySize         = 32 // AES-256
+	envelopeVersion = 1
+)
+
+// NewKey returns a random AES-256 data key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// WrapKey encrypts a data key for the holder of pub.
+func WrapKey(pub *rsa.PublicKey, key []byte) ([]byte, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+	return wrapped, nil
+}
+
+// UnwrapKey recovers a data key wrapped for this encryptor's public key.
+func (e *Encryptor) UnwrapKey(wrapped []byte) ([]byte, error) {
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, e.privateKey, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("unwrapped key has invalid size %d", len(key))
+	}
+	return key, nil
+}
+
+// Seal encrypts data for the holder of pub. A fresh AES-256-GCM key
+// encrypts the data and is itself wrapped with RSA-OAEP, so the size of
+// data is not limited by the RSA key. The envelope is
+// version(1) | wrapped key length(2) | wrapped key | GCM nonce | ciphertext.
+func Seal(pub *rsa.PublicKey, data []byte) ([]byte, error) {
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := WrapKey(pub, key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, 3+len(wrapped)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, envelopeVersion)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte{envelopeVersion}), nil
+}
+
+// Open decrypts an envelope produced by Seal for this encryptor's key.
+func (e *Encryptor) Open(envelope []byte) ([]byte, error) {
+	if len(envelope) < 3 || envelope[0] != envelopeVersion {
+		return nil, fmt.Errorf("decryption error: unsupported envelope")
+	}
+	wrappedLen := int(binary.BigEndian.Uint16(envelope[1:3]))
+	rest := envelope[3:]
+	if len(rest) < wrappedLen {
+		return nil, fmt.Errorf("decryption error: truncated envelope")
+	}
+
+	key, err := e.UnwrapKey(rest[:wrappedLen])
+	if err != nil {
+		return nil, fmt.Errorf("decryption error: %w", err)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	rest = rest[wrappedLen:]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("decryption error: truncated envelope")
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], envelope[:1])
+	if err != nil {
+		return nil, fmt.Errorf("decryption error: %w", err)
+	}
+	return plaintext, nil
+}
+
+// ChunkCipher encrypts the chunks of one file or stream with AES-256-GCM.
+// Nonces are derived from the chunk index, so a key must never be used for
+// more than one file or stream; the index and a final-chunk flag are
+// authenticated so chunks cannot be reordered, dropped from the end, or
+// moved between positions.
+type ChunkCipher struct {
+	aead cipher.AEAD
+}
+
+func NewChunkCipher(key []byte) (*ChunkCipher, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunkCipher{aead: aead}, nil
+}
+
+// Overhead is the number of bytes SealChunk adds to each chunk.
+func (c *ChunkCipher) Overhead() int {
+	return c.aead.Overhead()
+}
+
+func (c *ChunkCipher) SealChunk(index uint64, final bool, data []byte) []byte {
+	nonce, ad := c.chunkParams(index, final)
+	return c.aead.Seal(nil, nonce, data, ad)
+}
+
+func (c *ChunkCipher) OpenChunk(index uint64, final bool, sealed []byte) ([]byte, error) {
+	nonce, ad := c.chunkParams(index, final)
+	plaintext, err := c.aead.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %d: %w", index, err)
+	}
+	return plaintext, nil
+}
+
+func (c *ChunkCipher) chunkParams(index uint64, final bool) ([]byte, []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+
+	ad := binary.BigEndian.AppendUint64(nil, index)
+	if final {
+		ad = append(ad, 1)
+	} else {
+		ad = append(ad, 0)
+	}
+	return nonce, ad
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+	return aead, nil
+}
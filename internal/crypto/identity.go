@@ -0,0 +1,95 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const identityPEMType = "PRIVATE KEY"
+
+// Identity is a node's long-term signing key. Its public key determines the
+// node's DHT ID.
+type Identity struct {
+	privateKey ed25519.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity key: %w", err)
+	}
+	return &Identity{privateKey: privateKey}, nil
+}
+
+// LoadOrCreateIdentity reads a PKCS#8 PEM encoded Ed25519 key from path,
+// generating and saving a new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return createIdentity(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != identityPEMType {
+		return nil, fmt.Errorf("identity file %s does not contain a PEM private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse identity key: %w", err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("identity key in %s is not an Ed25519 key", path)
+	}
+	return &Identity{privateKey: privateKey}, nil
+}
+
+func createIdentity(path string) (*Identity, error) {
+	identity, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(identity.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode identity key: %w", err)
+	}
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create identity directory: %w", err)
+		}
+	}
+	// O_EXCL so two nodes racing on the same path cannot both write a key.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create identity file: %w", err)
+	}
+	defer file.Close()
+
+	if err := pem.Encode(file, &pem.Block{Type: identityPEMType, Bytes: der}); err != nil {
+		return nil, fmt.Errorf("failed to write identity file: %w", err)
+	}
+	return identity, file.Close()
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.privateKey.Public().(ed25519.PublicKey)
+}
+
+func (id *Identity) PrivateKey() ed25519.PrivateKey {
+	return id.privateKey
+}
+
+func (id *Identity) Sign(message []byte) []byte {
+	return ed25519.Sign(id.privateKey, message)
+}
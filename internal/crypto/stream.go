@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	StreamSegmentSize = 64 * 1024
+	streamSaltSize    = 16
+	streamFinalFlag   = 1
+)
+
+var streamKeyLabel = []byte("meshfile stream v1")
+
+// streamCipher derives a per-stream key from key and a random salt, so the
+// same session key can encrypt many streams without reusing nonces.
+func streamCipher(key, salt []byte) (*ChunkCipher, error) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(streamKeyLabel)
+	mac.Write(salt)
+	return NewChunkCipher(mac.Sum(nil))
+}
+
+// EncryptWriter encrypts a stream segment by segment. The stream starts
+// with a random salt; each segment is framed as
+// flags(1) | sealed length(4) | sealed segment. Close must be called to
+// write the final segment, without which the reader reports truncation.
+type EncryptWriter struct {
+	w      io.Writer
+	cipher *ChunkCipher
+	buf    []byte
+	index  uint64
+	closed bool
+}
+
+func NewEncryptWriter(w io.Writer, key []byte) (*EncryptWriter, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	c, err := streamCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &EncryptWriter{w: w, cipher: c}, nil
+}
+
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, fmt.Errorf("write to closed encrypt writer")
+	}
+	ew.buf = append(ew.buf, p...)
+	// Hold back a full segment until more data arrives, since only Close
+	// knows which segment is the final one.
+	for len(ew.buf) > StreamSegmentSize {
+		if err := ew.writeSegment(ew.buf[:StreamSegmentSize], false); err != nil {
+			return 0, err
+		}
+		ew.buf = ew.buf[StreamSegmentSize:]
+	}
+	return len(p), nil
+}
+
+// Close writes the final segment. It does not close the underlying writer.
+func (ew *EncryptWriter) Close() error {
+	if ew.closed {
+		return nil
+	}
+	ew.closed = true
+	return ew.writeSegment(ew.buf, true)
+}
+
+func (ew *EncryptWriter) writeSegment(data []byte, final bool) error {
+	sealed := ew.cipher.SealChunk(ew.index, final, data)
+	ew.index++
+
+	header := make([]byte, 5)
+	if final {
+		header[0] = streamFinalFlag
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := ew.w.Write(header); err != nil {
+		return err
+	}
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// DecryptReader reverses EncryptWriter, authenticating each segment before
+// returning any of its plaintext.
+type DecryptReader struct {
+	r      io.Reader
+	cipher *ChunkCipher
+	buf    []byte
+	index  uint64
+	done   bool
+}
+
+func NewDecryptReader(r io.Reader, key []byte) (*DecryptReader, error) {
+	salt := make([]byte, streamSaltSize)
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %w", err)
+	}
+	c, err := streamCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReader{r: r, cipher: c}, nil
+}
+
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.readSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *DecryptReader) readSegment() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(dr.r, header); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	final := header[0] == streamFinalFlag
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > StreamSegmentSize+uint32(dr.cipher.Overhead()) {
+		return fmt.Errorf("encrypted segment of %d bytes is too large", size)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(dr.r, sealed); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	plaintext, err := dr.cipher.OpenChunk(dr.index, final, sealed)
+	if err != nil {
+		return err
+	}
+	dr.index++
+	dr.buf = plaintext
+	dr.done = final
+	return nil
+}
+
+// EncryptStream copies r to w encrypted under key.
+func EncryptStream(w io.Writer, r io.Reader, key []byte) error {
+	ew, err := NewEncryptWriter(w, key)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ew, r); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// DecryptStream copies the plaintext of an encrypted stream from r to w.
+func DecryptStream(w io.Writer, r io.Reader, key []byte) error {
+	dr, err := NewDecryptReader(r, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, dr)
+	return err
+}
@@ -3,61 +3,308 @@ package dht
 import (
 	"bytes"
 	"crypto/sha1"
+	"math/bits"
 	"sort"
 	"sync"
 	"time"
 )
 
+const (
+	IDLength = sha1.Size
+	IDBits   = IDLength * 8
+	K        = 20 // bucket size and replication parameter
+)
+
 type Node struct {
 	ID       []byte
 	Address  string
 	LastSeen time.Time
 }
 
+// PingFunc reports whether a node is still reachable. It is used to decide
+// whether the least recently seen entry of a full bucket may be evicted.
+type PingFunc func(node *Node) bool
+
+type bucket struct {
+	nodes        []*Node // least recently seen first
+	replacements []*Node // most recently seen last
+	pinging      bool
+}
+
 type DHT struct {
-	Nodes   map[string]*Node
-	mu      sync.RWMutex
-	LocalID []byte
+	LocalID   []byte
+	buckets   [IDBits]*bucket
+	providers map[string][]*ProviderRecord
+	keyCounts map[string]int // provider records held per remote node ID
+	mu        sync.RWMutex
+	pinger    PingFunc
 }
 
 func NewDHT(address string) *DHT {
 	id := sha1.Sum([]byte(address))
-	return &DHT{
-		Nodes:   make(map[string]*Node),
-		LocalID: id[:],
+	return NewDHTWithID(id[:])
+}
+
+// NewDHTWithID creates a routing table for a node with the given ID, such
+// as one derived with IDFromPublicKey.
+func NewDHTWithID(localID []byte) *DHT {
+	d := &DHT{
+		LocalID:   localID,
+		providers: make(map[string][]*ProviderRecord),
+		keyCounts: make(map[string]int),
+	}
+	for i := range d.buckets {
+		d.buckets[i] = &bucket{}
+	}
+	return d
+}
+
+// IDFromPublicKey derives a node ID from its identity public key, so that
+// the ID stays the same across restarts and address changes.
+func IDFromPublicKey(publicKey []byte) []byte {
+	id := sha1.Sum(publicKey)
+	return id[:]
+}
+
+// KeyID maps an arbitrary key (such as a SHA-256 content hash) into the
+// 160-bit ID space. Keys that already have the ID length are used as is.
+func KeyID(key []byte) []byte {
+	if len(key) == IDLength {
+		return key
 	}
+	id := sha1.Sum(key)
+	return id[:]
+}
+
+func (d *DHT) SetPinger(pinger PingFunc) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pinger = pinger
 }
 
+// AddNode records a contact in the bucket matching its distance from
+// LocalID. Known contacts are moved to the tail of their bucket. When the
+// bucket is full the newcomer goes to the replacement cache and the oldest
+// entry is pinged in the background; it is evicted only if it fails to
+// answer.
 func (d *DHT) AddNode(node *Node) {
+	if len(node.ID) != IDLength || bytes.Equal(node.ID, d.LocalID) {
+		return
+	}
+	contact := *node
+
+	d.mu.Lock()
+	b := d.buckets[commonPrefixLen(d.LocalID, contact.ID)]
+	if i := indexOf(b.nodes, contact.ID); i >= 0 {
+		b.nodes = append(removeAt(b.nodes, i), &contact)
+		d.mu.Unlock()
+		return
+	}
+	if len(b.nodes) < K {
+		b.nodes = append(b.nodes, &contact)
+		d.mu.Unlock()
+		return
+	}
+
+	b.addReplacement(&contact)
+	if b.pinging || d.pinger == nil {
+		d.mu.Unlock()
+		return
+	}
+	b.pinging = true
+	oldest := *b.nodes[0]
+	pinger := d.pinger
+	d.mu.Unlock()
+
+	go d.checkOldest(b, &oldest, pinger)
+}
+
+func (d *DHT) checkOldest(b *bucket, oldest *Node, pinger PingFunc) {
+	alive := pinger(oldest)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b.pinging = false
+
+	i := indexOf(b.nodes, oldest.ID)
+	if i < 0 {
+		return
+	}
+	if alive {
+		contact := b.nodes[i]
+		contact.LastSeen = time.Now()
+		b.nodes = append(removeAt(b.nodes, i), contact)
+		return
+	}
+	b.nodes = removeAt(b.nodes, i)
+	b.promote()
+}
+
+// RemoveNode drops a contact from the routing table, filling its slot from
+// the replacement cache if possible.
+func (d *DHT) RemoveNode(id []byte) bool {
+	if len(id) != IDLength {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.buckets[commonPrefixLen(d.LocalID, id)]
+	if i := indexOf(b.replacements, id); i >= 0 {
+		b.replacements = removeAt(b.replacements, i)
+	}
+	i := indexOf(b.nodes, id)
+	if i < 0 {
+		return false
+	}
+	b.nodes = removeAt(b.nodes, i)
+	b.promote()
+	return true
+}
+
+func (d *DHT) GetNode(id []byte) (*Node, bool) {
+	if len(id) != IDLength {
+		return nil, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	b := d.buckets[commonPrefixLen(d.LocalID, id)]
+	if i := indexOf(b.nodes, id); i >= 0 {
+		contact := *b.nodes[i]
+		return &contact, true
+	}
+	return nil, false
+}
+
+func (d *DHT) AllNodes() []*Node {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var nodeList []*Node
+	for _, b := range d.buckets {
+		nodeList = appendCopies(nodeList, b.nodes)
+	}
+	return nodeList
+}
+
+func (d *DHT) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	count := 0
+	for _, b := range d.buckets {
+		count += len(b.nodes)
+	}
+	return count
+}
+
+func (d *DHT) Clear() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	d.Nodes[string(node.ID)] = node
+
+	for i := range d.buckets {
+		d.buckets[i] = &bucket{}
+	}
+	d.providers = make(map[string][]*ProviderRecord)
+	d.keyCounts = make(map[string]int)
 }
 
+// FindClosestNodes returns up to count contacts ordered by XOR distance to
+// target. Only the buckets that can hold the closest contacts are visited:
+// the bucket sharing the target's prefix first, then the buckets further
+// from LocalID (all at the same distance prefix), then the nearer ones in
+// decreasing prefix order.
 func (d *DHT) FindClosestNodes(target []byte, count int) []*Node {
+	target = KeyID(target)
+
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
+	cpl := commonPrefixLen(d.LocalID, target)
+
 	var nodeList []*Node
-	for _, node := range d.Nodes {
-		nodeList = append(nodeList, node)
+	if cpl < IDBits {
+		nodeList = appendCopies(nodeList, d.buckets[cpl].nodes)
+	}
+	if len(nodeList) < count {
+		for i := cpl + 1; i < IDBits; i++ {
+			nodeList = appendCopies(nodeList, d.buckets[i].nodes)
+		}
+	}
+	for i := cpl - 1; i >= 0 && len(nodeList) < count; i-- {
+		nodeList = appendCopies(nodeList, d.buckets[i].nodes)
+	}
+
+	SortByDistance(nodeList, target)
+
+	if len(nodeList) > count {
+		return nodeList[:count]
 	}
+	return nodeList
+}
 
+// SortByDistance orders nodes by increasing XOR distance to target.
+func SortByDistance(nodeList []*Node, target []byte) {
 	sort.Slice(nodeList, func(i, j int) bool {
 		distI := xorDistance(nodeList[i].ID, target)
 		distJ := xorDistance(nodeList[j].ID, target)
 		return bytes.Compare(distI, distJ) < 0
 	})
+}
 
-	if len(nodeList) > count {
-		return nodeList[:count]
+func (b *bucket) addReplacement(node *Node) {
+	if i := indexOf(b.replacements, node.ID); i >= 0 {
+		b.replacements = removeAt(b.replacements, i)
 	}
-	return nodeList
+	b.replacements = append(b.replacements, node)
+	if len(b.replacements) > K {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+func (b *bucket) promote() {
+	if len(b.replacements) == 0 || len(b.nodes) >= K {
+		return
+	}
+	last := len(b.replacements) - 1
+	b.nodes = append(b.nodes, b.replacements[last])
+	b.replacements = b.replacements[:last]
+}
+
+func indexOf(nodeList []*Node, id []byte) int {
+	for i, node := range nodeList {
+		if bytes.Equal(node.ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+func removeAt(nodeList []*Node, i int) []*Node {
+	return append(nodeList[:i:i], nodeList[i+1:]...)
+}
+
+func appendCopies(dst []*Node, src []*Node) []*Node {
+	for _, node := range src {
+		contact := *node
+		dst = append(dst, &contact)
+	}
+	return dst
+}
+
+func commonPrefixLen(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return IDBits
 }
 
 func xorDistance(a, b []byte) []byte {
 	distance := make([]byte, len(a))
-	for i := 0; i < len(a); i++ {
+	for i := 0; i < len(a) && i < len(b); i++ {
 		distance[i] = a[i] ^ b[i]
 	}
 	return distance
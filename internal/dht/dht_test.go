@@ -1,21 +1,38 @@
 package dht
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 )
 
+// testID returns a full-length ID ending in the given byte.
+func testID(b byte) []byte {
+	id := make([]byte, IDLength)
+	id[IDLength-1] = b
+	return id
+}
+
+// farID returns distinct IDs that all land in bucket 0 of d.
+func farID(d *DHT, i int) []byte {
+	id := make([]byte, IDLength)
+	id[0] = d.LocalID[0] ^ 0x80
+	id[1] = byte(i)
+	return id
+}
+
 func TestDHTAddNode(t *testing.T) {
 	dht := NewDHT("localhost:3000")
 	node := &Node{
-		ID:       []byte("testID"),
+		ID:       testID(0x01),
 		Address:  "localhost:3001",
 		LastSeen: time.Now(),
 	}
 
 	dht.AddNode(node)
 
-	if _, ok := dht.Nodes[string(node.ID)]; !ok {
+	if _, ok := dht.GetNode(node.ID); !ok {
 		t.Errorf("Node not added to DHT")
 	}
 }
@@ -24,17 +41,17 @@ func TestDHTFindClosestNodes(t *testing.T) {
 	dht := NewDHT("localhost:3000")
 
 	node1 := &Node{
-		ID:       []byte{0x01},
+		ID:       testID(0x01),
 		Address:  "localhost:3001",
 		LastSeen: time.Now(),
 	}
 	node2 := &Node{
-		ID:       []byte{0x02},
+		ID:       testID(0x02),
 		Address:  "localhost:3002",
 		LastSeen: time.Now(),
 	}
 	node3 := &Node{
-		ID:       []byte{0x03},
+		ID:       testID(0x03),
 		Address:  "localhost:3003",
 		LastSeen: time.Now(),
 	}
@@ -43,7 +60,7 @@ func TestDHTFindClosestNodes(t *testing.T) {
 	dht.AddNode(node2)
 	dht.AddNode(node3)
 
-	target := []byte{0x02}
+	target := testID(0x02)
 	closestNodes := dht.FindClosestNodes(target, 2)
 
 	if len(closestNodes) != 2 {
@@ -51,6 +68,140 @@ func TestDHTFindClosestNodes(t *testing.T) {
 	}
 
 	if string(closestNodes[0].ID) != string(node2.ID) {
-		t.Errorf("Expected closest node to be node2, got %s", string(closestNodes[0].ID))
+		t.Errorf("Expected closest node to be node2, got %x", closestNodes[0].ID)
+	}
+}
+
+func TestDHTFullBucketKeepsLiveNode(t *testing.T) {
+	dht := NewDHT("localhost:3000")
+	pinged := make(chan []byte, 1)
+	dht.SetPinger(func(node *Node) bool {
+		pinged <- node.ID
+		return true
+	})
+
+	for i := 0; i < K; i++ {
+		dht.AddNode(&Node{ID: farID(dht, i), Address: "oldest"})
+	}
+	dht.AddNode(&Node{ID: farID(dht, K), Address: "newcomer"})
+
+	select {
+	case id := <-pinged:
+		if string(id) != string(farID(dht, 0)) {
+			t.Fatalf("Expected oldest node to be pinged, got %x", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Oldest node was not pinged")
+	}
+
+	// A successful ping moves the oldest node to the tail of its bucket.
+	waitFor(t, func() bool {
+		nodes := dht.AllNodes()
+		return string(nodes[len(nodes)-1].ID) == string(farID(dht, 0))
+	})
+	if _, ok := dht.GetNode(farID(dht, 0)); !ok {
+		t.Errorf("Live node was evicted")
+	}
+	if _, ok := dht.GetNode(farID(dht, K)); ok {
+		t.Errorf("Newcomer should stay in the replacement cache")
+	}
+
+	// Removing a contact promotes the cached newcomer.
+	dht.RemoveNode(farID(dht, 3))
+	if _, ok := dht.GetNode(farID(dht, K)); !ok {
+		t.Errorf("Replacement was not promoted")
+	}
+}
+
+func TestDHTFullBucketEvictsDeadNode(t *testing.T) {
+	dht := NewDHT("localhost:3000")
+	dht.SetPinger(func(node *Node) bool { return false })
+
+	for i := 0; i < K; i++ {
+		dht.AddNode(&Node{ID: farID(dht, i)})
+	}
+	dht.AddNode(&Node{ID: farID(dht, K)})
+
+	waitFor(t, func() bool {
+		_, ok := dht.GetNode(farID(dht, K))
+		return ok
+	})
+	if _, ok := dht.GetNode(farID(dht, 0)); ok {
+		t.Errorf("Dead node was not evicted")
+	}
+	if dht.Len() != K {
+		t.Errorf("Expected %d nodes, got %d", K, dht.Len())
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDHTProviders(t *testing.T) {
+	dht := NewDHT("localhost:3000")
+	key := []byte("content-hash")
+
+	dht.AddProvider(&ProviderRecord{Key: key, NodeID: testID(0x01), Address: "localhost:3001"})
+	dht.AddProvider(&ProviderRecord{Key: key, NodeID: testID(0x01), Address: "localhost:3011"})
+	dht.AddProvider(&ProviderRecord{
+		Key:     key,
+		NodeID:  testID(0x02),
+		Address: "localhost:3002",
+		Expires: time.Now().Add(10 * time.Millisecond),
+	})
+
+	providers := dht.GetProviders(key)
+	if len(providers) != 2 {
+		t.Fatalf("Expected 2 providers, got %d", len(providers))
+	}
+	if providers[0].Address != "localhost:3011" {
+		t.Errorf("Expected provider record to be refreshed, got %s", providers[0].Address)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if removed := dht.ExpireProviders(); removed != 1 {
+		t.Errorf("Expected 1 expired record, got %d", removed)
+	}
+	if providers := dht.GetProviders(key); len(providers) != 1 {
+		t.Errorf("Expected 1 provider after expiry, got %d", len(providers))
+	}
+}
+
+func TestDHTCapsKeysPerProvider(t *testing.T) {
+	dht := NewDHT("localhost:3000")
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%d", i)) }
+
+	for i := 0; i < MaxKeysPerProvider; i++ {
+		if err := dht.AddProvider(&ProviderRecord{Key: key(i), NodeID: testID(0x01), Address: "localhost:3001"}); err != nil {
+			t.Fatalf("Failed to add record %d: %v", i, err)
+		}
+	}
+	extra := &ProviderRecord{Key: key(MaxKeysPerProvider), NodeID: testID(0x01), Address: "localhost:3001"}
+	if err := dht.AddProvider(extra); !errors.Is(err, ErrTooManyKeys) {
+		t.Fatalf("Expected ErrTooManyKeys, got %v", err)
+	}
+	if err := dht.AddProvider(&ProviderRecord{Key: key(0), NodeID: testID(0x01), Address: "localhost:3011"}); err != nil {
+		t.Errorf("Expected a refresh to be accepted at the cap, got %v", err)
+	}
+	if err := dht.AddProvider(&ProviderRecord{Key: key(MaxKeysPerProvider), NodeID: testID(0x02), Address: "localhost:3002"}); err != nil {
+		t.Errorf("Expected another provider to be accepted, got %v", err)
+	}
+	if err := dht.AddProvider(&ProviderRecord{Key: key(MaxKeysPerProvider), NodeID: dht.LocalID, Address: "localhost:3000"}); err != nil {
+		t.Errorf("Expected the local node to be exempt, got %v", err)
+	}
+
+	dht.AddProvider(&ProviderRecord{Key: key(0), NodeID: testID(0x01), Address: "localhost:3001", Expires: time.Now().Add(time.Millisecond)})
+	time.Sleep(5 * time.Millisecond)
+	dht.ExpireProviders()
+	if err := dht.AddProvider(extra); err != nil {
+		t.Errorf("Expected room after a record expired, got %v", err)
 	}
 }
@@ -0,0 +1,129 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+const (
+	ProviderTTL        = 24 * time.Hour
+	MaxProvidersPerKey = K
+	MaxKeysPerProvider = 1024
+)
+
+var (
+	ErrInvalidProvider = errors.New("invalid provider record")
+	ErrTooManyKeys     = errors.New("provider has too many keys")
+)
+
+// ProviderRecord announces that the node NodeID serves the content
+// identified by Key at Address.
+type ProviderRecord struct {
+	Key     []byte
+	NodeID  []byte
+	Address string
+	Expires time.Time
+}
+
+// AddProvider stores or refreshes a provider record. The expiry is capped
+// at ProviderTTL from now so remote peers cannot pin records forever, and a
+// remote node may hold records for at most MaxKeysPerProvider keys.
+func (d *DHT) AddProvider(record *ProviderRecord) error {
+	if len(record.Key) == 0 || len(record.NodeID) != IDLength || record.Address == "" {
+		return ErrInvalidProvider
+	}
+	rec := *record
+	now := time.Now()
+	if maxExpiry := now.Add(ProviderTTL); rec.Expires.IsZero() || rec.Expires.After(maxExpiry) {
+		rec.Expires = maxExpiry
+	}
+	if !rec.Expires.After(now) {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	records := d.providers[string(rec.Key)]
+	for i, existing := range records {
+		if bytes.Equal(existing.NodeID, rec.NodeID) {
+			records[i] = &rec
+			return nil
+		}
+	}
+	local := bytes.Equal(rec.NodeID, d.LocalID)
+	if !local && d.keyCounts[string(rec.NodeID)] >= MaxKeysPerProvider {
+		return ErrTooManyKeys
+	}
+	if len(records) >= MaxProvidersPerKey {
+		// Drop the record closest to expiry to make room.
+		oldest := 0
+		for i, existing := range records {
+			if existing.Expires.Before(records[oldest].Expires) {
+				oldest = i
+			}
+		}
+		d.forgetKey(records[oldest].NodeID)
+		records = append(records[:oldest], records[oldest+1:]...)
+	}
+	d.providers[string(rec.Key)] = append(records, &rec)
+	if !local {
+		d.keyCounts[string(rec.NodeID)]++
+	}
+	return nil
+}
+
+// forgetKey drops one key from a provider's count. d.mu must be held.
+func (d *DHT) forgetKey(nodeID []byte) {
+	id := string(nodeID)
+	if _, ok := d.keyCounts[id]; !ok {
+		return
+	}
+	if d.keyCounts[id]--; d.keyCounts[id] == 0 {
+		delete(d.keyCounts, id)
+	}
+}
+
+// GetProviders returns the unexpired provider records for key.
+func (d *DHT) GetProviders(key []byte) []*ProviderRecord {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	var records []*ProviderRecord
+	for _, rec := range d.providers[string(key)] {
+		if rec.Expires.After(now) {
+			copied := *rec
+			records = append(records, &copied)
+		}
+	}
+	return records
+}
+
+// ExpireProviders drops expired provider records and returns how many
+// were removed.
+func (d *DHT) ExpireProviders() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for key, records := range d.providers {
+		live := records[:0]
+		for _, rec := range records {
+			if rec.Expires.After(now) {
+				live = append(live, rec)
+			} else {
+				d.forgetKey(rec.NodeID)
+				removed++
+			}
+		}
+		if len(live) == 0 {
+			delete(d.providers, key)
+		} else {
+			d.providers[key] = live
+		}
+	}
+	return removed
+}
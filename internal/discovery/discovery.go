@@ -0,0 +1,177 @@
+// Package discovery finds other nodes on the local network by periodically
+// announcing the node ID and DHT port to a UDP multicast group.
+//
+// Announcements are not authenticated. Receivers should treat them as
+// hints and verify the node ID when they connect.
+package discovery
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultGroup    = "239.255.77.77:7777" // organization-local scope
+	DefaultInterval = 5 * time.Second
+
+	magic   = "MESHFILE"
+	version = 1
+)
+
+// Peer is a node heard on the network. Address combines the source IP of
+// the announcement with the DHT port it advertised.
+type Peer struct {
+	ID      []byte
+	Address string
+}
+
+type Config struct {
+	Group     string        // multicast host:port; empty uses DefaultGroup
+	Interface string        // network interface name; empty lets the system choose
+	Interval  time.Duration // time between announcements; 0 uses DefaultInterval
+}
+
+type Service struct {
+	id       []byte
+	port     int
+	group    *net.UDPAddr
+	conn     *net.UDPConn
+	interval time.Duration
+	found    func(Peer)
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// Start joins the multicast group, announces id and port on it and calls
+// found for every announcement from another node.
+func Start(id []byte, port int, config *Config, found func(Peer)) (*Service, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	groupAddr := config.Group
+	if groupAddr == "" {
+		groupAddr = DefaultGroup
+	}
+	group, err := net.ResolveUDPAddr("udp4", groupAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multicast group %s: %w", groupAddr, err)
+	}
+	if !group.IP.IsMulticast() {
+		return nil, fmt.Errorf("%s is not a multicast address", groupAddr)
+	}
+
+	var ifi *net.Interface
+	if config.Interface != "" {
+		if ifi, err = net.InterfaceByName(config.Interface); err != nil {
+			return nil, fmt.Errorf("unknown interface %s: %w", config.Interface, err)
+		}
+	}
+	// The same socket sends announcements, so they leave through the
+	// interface the group was joined on.
+	conn, err := net.ListenMulticastUDP("udp4", ifi, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join multicast group %s: %w", groupAddr, err)
+	}
+
+	s := &Service{
+		id:       id,
+		port:     port,
+		group:    group,
+		conn:     conn,
+		interval: config.Interval,
+		found:    found,
+		done:     make(chan struct{}),
+	}
+	if s.interval <= 0 {
+		s.interval = DefaultInterval
+	}
+
+	s.wg.Add(2)
+	go s.announceLoop()
+	go s.listenLoop()
+	return s, nil
+}
+
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+	})
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	msg := encodeAnnouncement(s.id, s.port)
+	for {
+		if _, err := s.conn.WriteToUDP(msg, s.group); err != nil && !s.closed() {
+			log.Printf("LAN announcement failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Service) listenLoop() {
+	defer s.wg.Done()
+	buf := make([]byte, 512)
+	for {
+		size, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.closed() || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("LAN discovery read error: %v", err)
+			continue
+		}
+		id, port, ok := decodeAnnouncement(buf[:size])
+		if !ok || bytes.Equal(id, s.id) {
+			continue
+		}
+		s.found(Peer{ID: id, Address: net.JoinHostPort(src.IP.String(), strconv.Itoa(port))})
+	}
+}
+
+func (s *Service) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// An announcement is magic | version (1) | port (2) | ID.
+func encodeAnnouncement(id []byte, port int) []byte {
+	msg := append([]byte(magic), version, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(magic)+1:], uint16(port))
+	return append(msg, id...)
+}
+
+func decodeAnnouncement(msg []byte) ([]byte, int, bool) {
+	header := len(magic) + 3
+	if len(msg) <= header || string(msg[:len(magic)]) != magic || msg[len(magic)] != version {
+		return nil, 0, false
+	}
+	port := int(binary.BigEndian.Uint16(msg[len(magic)+1:]))
+	if port == 0 {
+		return nil, 0, false
+	}
+	return append([]byte(nil), msg[header:]...), port, true
+}
@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig uses a random group port on the loopback interface so tests
+// do not hear real nodes or each other.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	var loopback string
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Cannot list interfaces: %v", err)
+	}
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 && ifi.Flags&net.FlagUp != 0 {
+			loopback = ifi.Name
+		}
+	}
+	return &Config{
+		Group:     fmt.Sprintf("239.255.77.77:%d", 20000+rand.Intn(20000)),
+		Interface: loopback,
+		Interval:  50 * time.Millisecond,
+	}
+}
+
+func startService(t *testing.T, id []byte, port int, config *Config) <-chan Peer {
+	t.Helper()
+	found := make(chan Peer, 16)
+	s, err := Start(id, port, config, func(p Peer) {
+		select {
+		case found <- p:
+		default:
+		}
+	})
+	if err != nil {
+		t.Skipf("Multicast unavailable: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return found
+}
+
+func TestServicesFindEachOther(t *testing.T) {
+	config := testConfig(t)
+	idA := bytes.Repeat([]byte{0xAA}, 20)
+	idB := bytes.Repeat([]byte{0xBB}, 20)
+	foundByA := startService(t, idA, 3001, config)
+	startService(t, idB, 3002, config)
+
+	select {
+	case p := <-foundByA:
+		if !bytes.Equal(p.ID, idB) {
+			t.Errorf("Expected to hear node B, got %x", p.ID)
+		}
+		if !strings.HasSuffix(p.Address, ":3002") {
+			t.Errorf("Expected B's DHT port in address, got %s", p.Address)
+		}
+	case <-time.After(2 * time.Second):
+		t.Skip("No multicast announcements received; multicast may be unavailable")
+	}
+}
+
+func TestAnnouncementEncoding(t *testing.T) {
+	id := bytes.Repeat([]byte{0x01}, 20)
+	gotID, port, ok := decodeAnnouncement(encodeAnnouncement(id, 4242))
+	if !ok || !bytes.Equal(gotID, id) || port != 4242 {
+		t.Errorf("Round trip failed: %x %d %v", gotID, port, ok)
+	}
+
+	for _, msg := range [][]byte{nil, []byte("MESHFILE"), []byte("NOTMESH!\x01\x10\x92id")} {
+		if _, _, ok := decodeAnnouncement(msg); ok {
+			t.Errorf("Expected %q to be rejected", msg)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func sessionPair(t *testing.T, config *Config) (*Session, *Session) {
+	t.Helper()
+	a, b := net.Pipe()
+	client, server := Client(a, config), Server(b, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echo serves every stream by copying it back until EOF.
+func echo(s *Session) {
+	for {
+		st, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(st, st)
+			st.Close()
+		}()
+	}
+}
+
+func TestStreamsAreIndependent(t *testing.T) {
+	client, server := sessionPair(t, nil)
+	go echo(server)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Larger than the stream window, so flow control has to kick in.
+			data := make([]byte, 3*initialWindow+123)
+			rand.Read(data)
+
+			st, err := client.Open()
+			if err != nil {
+				t.Errorf("Failed to open stream: %v", err)
+				return
+			}
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+			got, err := io.ReadAll(st)
+			if err != nil {
+				t.Errorf("Failed to read echo: %v", err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Stream %d: echoed data does not match", st.ID())
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+}
+
+func TestSlowReaderDoesNotBlockOtherStreams(t *testing.T) {
+	client, server := sessionPair(t, nil)
+
+	stalled, err := client.Open()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	go stalled.Write(make([]byte, 2*initialWindow))
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	st.Write([]byte("ping"))
+
+	// The server never reads the first stream.
+	server.Accept()
+	second, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept stream: %v", err)
+	}
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(second, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected ping on second stream, got %q (%v)", buf, err)
+	}
+}
+
+func TestResetAndDeadlines(t *testing.T) {
+	client, server := sessionPair(t, nil)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	st.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+
+	remote, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept stream: %v", err)
+	}
+	st.Reset()
+	waitFor(t, func() bool {
+		_, err := remote.Read(make([]byte, 1))
+		return errors.Is(err, ErrStreamReset)
+	})
+	waitFor(t, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+}
+
+func TestStreamLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxStreams = 2
+	client, _ := sessionPair(t, config)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Open(); err != nil {
+			t.Fatalf("Failed to open stream: %v", err)
+		}
+	}
+	if _, err := client.Open(); err != ErrStreamLimit {
+		t.Errorf("Expected ErrStreamLimit, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.IdleTimeout = 50 * time.Millisecond
+	client, server := sessionPair(t, config)
+	go echo(server)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	// An open stream keeps the session alive.
+	time.Sleep(2 * config.IdleTimeout)
+	if client.IsClosed() {
+		t.Fatal("Session closed while a stream was open")
+	}
+
+	st.Close()
+	io.ReadAll(st)
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Idle session was not closed")
+	}
+	if _, err := client.Open(); err != ErrSessionClosed {
+		t.Errorf("Expected ErrSessionClosed, got %v", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,326 @@
+// Package mux multiplexes many reliable, ordered byte streams over a single
+// connection, in the style of yamux.
+//
+// Frames on the connection have a 10 byte header:
+//
+//	type (1) | flags (1) | stream ID (4) | length (4)
+//
+// Data frames carry length bytes of payload; window update frames carry no
+// payload and use length as the window increment. The side that opens the
+// session with Client uses odd stream IDs, the Server side even ones. Each
+// stream has its own receive window, so a reader that falls behind only
+// stalls its own stream.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize    = 10
+	initialWindow = 256 << 10
+	maxFrameSize  = 64 << 10
+)
+
+const (
+	typeData byte = iota
+	typeWindowUpdate
+)
+
+const (
+	flagSYN byte = 1 << iota
+	flagFIN
+	flagRST
+)
+
+var (
+	ErrSessionClosed = errors.New("mux: session closed")
+	ErrStreamReset   = errors.New("mux: stream reset")
+	ErrStreamLimit   = errors.New("mux: too many open streams")
+)
+
+type Config struct {
+	MaxStreams    int           // open streams per session, both directions
+	AcceptBacklog int           // streams opened by the peer but not yet accepted
+	IdleTimeout   time.Duration // close the session after this long without streams; 0 disables
+	WriteTimeout  time.Duration // give up on the connection if a frame cannot be written in time
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		MaxStreams:    256,
+		AcceptBacklog: 64,
+		WriteTimeout:  30 * time.Second,
+	}
+}
+
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	idle    *time.Timer
+
+	accept    chan *Stream
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Client starts a session on the dialing side of conn.
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server starts a session on the accepting side of conn.
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config *Config, firstID uint32) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	s := &Session{
+		conn:    conn,
+		config:  *config,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accept:  make(chan *Stream, max(config.AcceptBacklog, 1)),
+		done:    make(chan struct{}),
+	}
+	if s.config.IdleTimeout > 0 {
+		s.idle = time.AfterFunc(s.config.IdleTimeout, s.closeIfIdle)
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open starts a new stream to the peer.
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if len(s.streams) >= s.config.MaxStreams {
+		s.mu.Unlock()
+		return nil, ErrStreamLimit
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.addStream(st)
+	s.mu.Unlock()
+
+	if err := s.sendFrame(typeData, flagSYN, st.id, nil); err != nil {
+		s.removeStream(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, ErrSessionClosed
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed when the session shuts down.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the reason the session was closed, if any.
+func (s *Session) Err() error {
+	<-s.done
+	return s.err
+}
+
+func (s *Session) LocalAddr() net.Addr  { return s.conn.LocalAddr() }
+func (s *Session) RemoteAddr() net.Addr { return s.conn.RemoteAddr() }
+
+// Close tears down the connection and every stream on it.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		if s.idle != nil {
+			s.idle.Stop()
+		}
+		s.conn.Close()
+	})
+}
+
+// closeIfIdle holds s.mu while closing so that Open cannot hand out a
+// stream on a session that is about to go away.
+func (s *Session) closeIfIdle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.streams) == 0 {
+		s.closeWithError(ErrSessionClosed)
+	}
+}
+
+// addStream must be called with s.mu held.
+func (s *Session) addStream(st *Stream) {
+	s.streams[st.id] = st
+	if s.idle != nil {
+		s.idle.Stop()
+	}
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+	if len(s.streams) == 0 && s.idle != nil {
+		s.idle.Reset(s.config.IdleTimeout)
+	}
+}
+
+func (s *Session) sendFrame(typ, flags byte, id uint32, payload []byte) error {
+	return s.sendHeader(typ, flags, id, uint32(len(payload)), payload)
+}
+
+func (s *Session) sendHeader(typ, flags byte, id, length uint32, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = typ
+	frame[1] = flags
+	binary.BigEndian.PutUint32(frame[2:6], id)
+	binary.BigEndian.PutUint32(frame[6:10], length)
+	copy(frame[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if s.config.WriteTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	}
+	if _, err := s.conn.Write(frame); err != nil {
+		s.closeWithError(fmt.Errorf("mux: write failed: %w", err))
+		return ErrSessionClosed
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		typ, flags := header[0], header[1]
+		id := binary.BigEndian.Uint32(header[2:6])
+		length := binary.BigEndian.Uint32(header[6:10])
+
+		var err error
+		switch typ {
+		case typeData:
+			if length > maxFrameSize {
+				err = fmt.Errorf("mux: frame of %d bytes exceeds maximum", length)
+				break
+			}
+			data := make([]byte, length)
+			if _, err = io.ReadFull(s.conn, data); err == nil {
+				err = s.handleData(flags, id, data)
+			}
+		case typeWindowUpdate:
+			if st := s.stream(id); st != nil {
+				st.grow(length)
+			}
+		default:
+			err = fmt.Errorf("mux: unknown frame type %d", typ)
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleData(flags byte, id uint32, data []byte) error {
+	if flags&flagSYN != 0 {
+		if err := s.incoming(id); err != nil {
+			return err
+		}
+	}
+	st := s.stream(id)
+	if st == nil {
+		// Frames racing with a local reset are dropped.
+		return nil
+	}
+	return st.receive(flags, data)
+}
+
+// incoming registers a stream opened by the peer, refusing it if the
+// stream or backlog limit is reached.
+func (s *Session) incoming(id uint32) error {
+	s.mu.Lock()
+	if id%2 == s.nextID%2 {
+		s.mu.Unlock()
+		return fmt.Errorf("mux: peer opened stream %d with a local ID", id)
+	}
+	if _, ok := s.streams[id]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("mux: duplicate stream %d", id)
+	}
+	if len(s.streams) >= s.config.MaxStreams {
+		s.mu.Unlock()
+		return s.sendFrame(typeData, flagRST, id, nil)
+	}
+	st := newStream(s, id)
+	s.addStream(st)
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+		return nil
+	default:
+		st.Reset()
+		return nil
+	}
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
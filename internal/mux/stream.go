@@ -0,0 +1,249 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one logical connection within a session. It implements
+// net.Conn; Close half-closes the stream and Reset aborts it.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mu            sync.Mutex
+	recvBuf       bytes.Buffer
+	recvWindow    uint32 // bytes the peer may still send
+	pendingUpdate uint32 // bytes read but not yet returned to the peer's window
+	sendWindow    uint32
+	readClosed    bool // FIN received
+	writeClosed   bool // FIN sent
+	reset         bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    s,
+		recvWindow: initialWindow,
+		sendWindow: initialWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(p []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(p)
+			st.pendingUpdate += uint32(n)
+			var update uint32
+			if st.pendingUpdate >= initialWindow/2 && !st.readClosed {
+				update = st.pendingUpdate
+				st.pendingUpdate = 0
+				st.recvWindow += update
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				st.session.sendHeader(typeWindowUpdate, 0, st.id, update, nil)
+			}
+			return n, nil
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.readClosed {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.session.IsClosed() {
+			st.mu.Unlock()
+			return 0, ErrSessionClosed
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.recvNotify, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.mu.Lock()
+		switch {
+		case st.reset:
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		case st.writeClosed:
+			st.mu.Unlock()
+			return written, io.ErrClosedPipe
+		case st.session.IsClosed():
+			st.mu.Unlock()
+			return written, ErrSessionClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.sendNotify, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(p)-written, int(st.sendWindow), maxFrameSize)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.sendFrame(typeData, 0, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// wait blocks until notify fires, the deadline passes or the session
+// closes. Callers re-check the stream state afterwards.
+func (st *Stream) wait(notify chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.done:
+		return nil
+	}
+}
+
+// Close sends FIN: the peer reads EOF once it has consumed everything
+// written so far. Reads continue until the peer closes its side too.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.writeClosed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.writeClosed = true
+	done := st.readClosed
+	st.mu.Unlock()
+
+	err := st.session.sendFrame(typeData, flagFIN, st.id, nil)
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions, waking any blocked reads and
+// writes.
+func (st *Stream) Reset() {
+	st.mu.Lock()
+	if st.reset {
+		st.mu.Unlock()
+		return
+	}
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+
+	st.session.sendFrame(typeData, flagRST, st.id, nil)
+	st.session.removeStream(st.id)
+}
+
+func (st *Stream) receive(flags byte, data []byte) error {
+	st.mu.Lock()
+	if uint32(len(data)) > st.recvWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("mux: stream %d exceeded its receive window", st.id)
+	}
+	st.recvWindow -= uint32(len(data))
+	st.recvBuf.Write(data)
+
+	remove := false
+	if flags&flagFIN != 0 {
+		st.readClosed = true
+		remove = st.writeClosed
+	}
+	if flags&flagRST != 0 {
+		st.reset = true
+		remove = true
+	}
+	st.mu.Unlock()
+
+	notify(st.recvNotify)
+	if flags&flagRST != 0 {
+		notify(st.sendNotify)
+	}
+	if remove {
+		st.session.removeStream(st.id)
+	}
+	return nil
+}
+
+func (st *Stream) grow(delta uint32) {
+	st.mu.Lock()
+	st.sendWindow += delta
+	st.mu.Unlock()
+	notify(st.sendNotify)
+}
+
+func (st *Stream) LocalAddr() net.Addr  { return st.session.LocalAddr() }
+func (st *Stream) RemoteAddr() net.Addr { return st.session.RemoteAddr() }
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.recvNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.sendNotify)
+	return nil
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
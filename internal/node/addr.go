@@ -0,0 +1,155 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// Addresses. A node binds to listenAddress and tells other nodes to reach
+// it at advertisedAddress. Unless -advertise is given, the advertised host
+// comes from what peers report seeing in PONG (the observed address),
+// falling back to the first non-loopback interface address.
+
+const (
+	// An observed IP is only used once this many peers report it, so a
+	// single peer cannot redirect everyone else away from us.
+	minObservedReporters = 2
+	// Each peer's latest report is kept, for at most this many peers.
+	maxObservedReporters = 64
+)
+
+// ListenAddr returns the address the DHT service is bound to, with the
+// port the kernel chose if the configured port was 0. It is nil until the
+// node is started.
+func (n *Node) ListenAddr() net.Addr {
+	if n.listener == nil {
+		return nil
+	}
+	return n.listener.Addr()
+}
+
+// FileServerAddr returns the address the HTTP file server is bound to. It
+// is nil until the node is started.
+func (n *Node) FileServerAddr() net.Addr {
+	return n.fileAddr
+}
+
+func (n *Node) listenAddress() string {
+	if n.config.ListenAddr != "" {
+		return n.config.ListenAddr
+	}
+	return fmt.Sprintf(":%d", n.config.Port)
+}
+
+func (n *Node) listenPort() string {
+	if addr, ok := n.ListenAddr().(*net.TCPAddr); ok {
+		return strconv.Itoa(addr.Port)
+	}
+	if _, port, err := net.SplitHostPort(n.listenAddress()); err == nil {
+		return port
+	}
+	return strconv.Itoa(n.config.Port)
+}
+
+func (n *Node) advertisedAddress() string {
+	if n.config.AdvertiseAddr != "" {
+		return n.config.AdvertiseAddr
+	}
+	port := n.listenPort()
+	if host, _, err := net.SplitHostPort(n.listenAddress()); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			return net.JoinHostPort(host, port)
+		}
+	}
+	if observed := n.ObservedAddrs(); len(observed) > 0 {
+		return net.JoinHostPort(observed[0], port)
+	}
+	if ip := interfaceIP(); ip != nil {
+		return net.JoinHostPort(ip.String(), port)
+	}
+	return net.JoinHostPort("127.0.0.1", port)
+}
+
+// recordObserved notes the IP a peer saw our connection come from,
+// replacing what that peer reported before. Loopback, unspecified and
+// link-local IPs say nothing about how other hosts reach us and are
+// ignored.
+func (n *Node) recordObserved(observed string, peerID []byte) {
+	host, _, err := net.SplitHostPort(observed)
+	if err != nil {
+		return
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsGlobalUnicast() {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.observed == nil {
+		n.observed = make(map[string]string)
+	}
+	if _, ok := n.observed[string(peerID)]; !ok && len(n.observed) >= maxObservedReporters {
+		for reporter := range n.observed {
+			delete(n.observed, reporter)
+			break
+		}
+	}
+	n.observed[string(peerID)] = host
+}
+
+// ObservedAddrs returns the IPs at least minObservedReporters peers have
+// seen this node connect from, most widely reported first.
+func (n *Node) ObservedAddrs() []string {
+	n.mu.RLock()
+	counts := make(map[string]int)
+	for _, host := range n.observed {
+		counts[host]++
+	}
+	n.mu.RUnlock()
+
+	var hosts []string
+	for host, count := range counts {
+		if count >= minObservedReporters {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if ci, cj := counts[hosts[i]], counts[hosts[j]]; ci != cj {
+			return ci > cj
+		}
+		return hosts[i] < hosts[j]
+	})
+	return hosts
+}
+
+// reachableAddress fixes up an address a peer reported for itself. A peer
+// that only knows itself as localhost or 0.0.0.0 is reachable at the IP
+// its connection came from instead.
+func reachableAddress(reported string, seen net.Addr) string {
+	host, port, err := net.SplitHostPort(reported)
+	if err != nil {
+		return reported
+	}
+	tcpAddr, ok := seen.(*net.TCPAddr)
+	if !ok || tcpAddr.IP.IsLoopback() {
+		return reported
+	}
+	if ip := net.ParseIP(host); host == "" || host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+		return net.JoinHostPort(tcpAddr.IP.String(), port)
+	}
+	return reported
+}
+
+func interfaceIP() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
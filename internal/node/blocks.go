@@ -0,0 +1,135 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"meshfile/internal/store"
+	"meshfile/internal/transfer"
+	"os"
+	"sort"
+)
+
+// openBlockStore opens the block store under the configured data
+// directory, or under a temporary directory that Stop removes.
+func (n *Node) openBlockStore() error {
+	dir := n.config.DataDir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "meshfile-")
+		if err != nil {
+			return fmt.Errorf("failed to create data directory: %w", err)
+		}
+		n.tempDataDir = tmp
+		dir = tmp
+	}
+	blocks, err := store.Open(dir)
+	if err != nil {
+		n.removeTempDataDir()
+		return err
+	}
+	n.blocks = blocks
+	return nil
+}
+
+func (n *Node) removeTempDataDir() {
+	if n.tempDataDir != "" {
+		os.RemoveAll(n.tempDataDir)
+		n.tempDataDir = ""
+	}
+}
+
+// importFile splits a file into chunks, copies each one into the block
+// store and builds the Merkle tree whose root identifies the file. On
+// failure the blocks it stored are released again.
+func (n *Node) importFile(file io.Reader, size int64) ([]transfer.ChunkInfo, *transfer.MerkleTree, error) {
+	chunker := transfer.NewFileChunker(file, size)
+	chunker.Chunker = n.config.Chunker
+	var stored []transfer.ChunkInfo
+	err := chunker.ScanData(func(info transfer.ChunkInfo, data []byte) error {
+		if _, err := n.blocks.Put(data); err != nil {
+			return err
+		}
+		stored = append(stored, info)
+		return nil
+	})
+	if err != nil {
+		n.releaseChunks(stored)
+		return nil, nil, fmt.Errorf("failed to import file: %w", err)
+	}
+
+	chunks := chunker.ChunkInfos()
+	manifest := transfer.Manifest{Size: size, Chunks: chunks}
+	return chunks, transfer.NewMerkleTree(manifest.ChunkHashes()), nil
+}
+
+// releaseChunks drops a file's references to its blocks and deletes the
+// blocks no other file uses.
+func (n *Node) releaseChunks(chunks []transfer.ChunkInfo) {
+	for _, chunk := range chunks {
+		if err := n.blocks.Release(chunk.Hash); err != nil {
+			log.Printf("Failed to release block: %v", err)
+		}
+	}
+}
+
+// fileReader reads a shared file back out of the block store, loading one
+// chunk at a time. It implements io.ReadSeeker so it can back
+// http.ServeContent.
+type fileReader struct {
+	blocks *store.Store
+	chunks []transfer.ChunkInfo
+	size   int64
+	offset int64
+
+	current int    // index of the chunk in data, -1 if none
+	data    []byte // contents of the current chunk
+}
+
+func (n *Node) newFileReader(file *FileInfo) *fileReader {
+	return &fileReader{blocks: n.blocks, chunks: file.Chunks, size: file.Size, current: -1}
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.chunks), func(i int) bool {
+		return r.chunks[i].Offset+r.chunks[i].Size > r.offset
+	})
+	if i == len(r.chunks) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if i != r.current {
+		data, err := r.blocks.Get(r.chunks[i].Hash)
+		if err != nil {
+			return 0, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		r.current, r.data = i, data
+	}
+	read := copy(p, r.data[r.offset-r.chunks[i].Offset:])
+	r.offset += int64(read)
+	return read, nil
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// BlockStore returns the store holding the chunks of shared files. It is
+// nil unless the node is running.
+func (n *Node) BlockStore() *store.Store {
+	return n.blocks
+}
@@ -0,0 +1,54 @@
+package node
+
+import (
+	"context"
+	"log"
+	"meshfile/internal/dht"
+	"time"
+)
+
+const (
+	bootstrapInitialBackoff = time.Second
+	bootstrapMaxBackoff     = time.Minute
+)
+
+// bootstrap joins the network through the configured bootstrap peers,
+// retrying with exponential backoff until at least one of them answers.
+func (n *Node) bootstrap() {
+	backoff := bootstrapInitialBackoff
+	for !n.joinNetwork(n.ctx) {
+		log.Printf("Bootstrap failed, retrying in %s", backoff)
+		if !n.sleep(backoff) {
+			return
+		}
+		backoff *= 2
+		if backoff > bootstrapMaxBackoff {
+			backoff = bootstrapMaxBackoff
+		}
+	}
+}
+
+// joinNetwork pings every bootstrap peer and, if any of them answered,
+// runs a lookup for our own ID to populate the routing table.
+func (n *Node) joinNetwork(ctx context.Context) bool {
+	joined := false
+	for _, address := range n.config.BootstrapPeers {
+		contact, err := n.ping(ctx, &dht.Node{Address: address})
+		if err != nil {
+			log.Printf("Failed to reach bootstrap peer %s: %v", address, err)
+			continue
+		}
+		n.dht.AddNode(contact)
+		n.addPeerContact(contact)
+		joined = true
+	}
+	if !joined {
+		return false
+	}
+
+	if _, err := n.Lookup(ctx, n.dht.LocalID); err != nil {
+		log.Printf("Self-lookup failed: %v", err)
+	}
+	log.Printf("Joined network via bootstrap peers, %d nodes known", n.dht.Len())
+	return true
+}
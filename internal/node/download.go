@@ -0,0 +1,156 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"meshfile/internal/dht"
+	"meshfile/internal/transfer"
+	"os"
+)
+
+// Download fetches the shared file identified by hash from the providers
+// announced in the DHT and writes it to destPath. Chunks are fetched from
+// all providers in parallel into a partial file; a sidecar state file
+// records the verified chunks so that calling Download again after an
+// interruption only fetches what is missing. Providers that cannot serve a
+// manifest are asked for the whole file instead. The file is only renamed
+// into place once its content hash matches. Stopping the node cancels the
+// download.
+func (n *Node) Download(ctx context.Context, hash []byte, destPath string) error {
+	done, err := n.track()
+	if err != nil {
+		return err
+	}
+	defer done()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(n.ctx, cancel)()
+
+	providers, err := n.FindProviders(ctx, hash)
+	if err != nil {
+		return fmt.Errorf("no peers found for file %x: %w", hash, err)
+	}
+
+	state, out, err := n.openPartial(ctx, providers, hash, destPath)
+	if err != nil {
+		log.Printf("Falling back to single-peer download of %x: %v", hash, err)
+		return n.downloadWhole(ctx, providers, hash, destPath)
+	}
+	defer out.Close()
+	defer state.close()
+
+	if err := n.swarmDownload(ctx, providers, hash, state, out); err != nil {
+		return fmt.Errorf("failed to download file %x (%d of %d chunks saved for resume): %w",
+			hash, len(state.done), len(state.Manifest.Chunks), err)
+	}
+
+	err = finishDownload(out, state.Manifest, partPath(destPath), destPath)
+	if err != nil {
+		// The partial data cannot be trusted any more; start over next time.
+		os.Remove(partPath(destPath))
+	}
+	state.remove()
+	return err
+}
+
+// openPartial resumes the partial download for destPath if one exists for
+// this hash, or starts a new one using a manifest from the providers.
+func (n *Node) openPartial(ctx context.Context, providers []*dht.ProviderRecord, hash []byte, destPath string) (*downloadState, *os.File, error) {
+	state, err := loadDownloadState(destPath, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state != nil {
+		out, err := os.OpenFile(partPath(destPath), os.O_RDWR, 0644)
+		if err == nil {
+			state.verify(out)
+			if err := out.Truncate(state.Manifest.Size); err != nil {
+				out.Close()
+				return nil, nil, fmt.Errorf("failed to allocate output file: %w", err)
+			}
+			if err := state.save(); err != nil {
+				out.Close()
+				return nil, nil, err
+			}
+			log.Printf("Resuming download of %x with %d of %d chunks", hash, len(state.done), len(state.Manifest.Chunks))
+			return state, out, nil
+		}
+	}
+
+	manifest, err := n.fetchManifest(ctx, providers, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	state = newDownloadState(destPath, hash, manifest)
+
+	out, err := os.Create(partPath(destPath))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+	if err := out.Truncate(manifest.Size); err != nil {
+		out.Close()
+		return nil, nil, fmt.Errorf("failed to allocate output file: %w", err)
+	}
+	if err := state.save(); err != nil {
+		out.Close()
+		return nil, nil, err
+	}
+	return state, out, nil
+}
+
+func (n *Node) downloadWhole(ctx context.Context, providers []*dht.ProviderRecord, hash []byte, destPath string) error {
+	var err error
+	for _, provider := range providers {
+		err = n.downloadFrom(ctx, providerContact(provider), hash, destPath)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Download of %x from %s failed: %v", hash, provider.Address, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("failed to download file %x: %w", hash, err)
+}
+
+func (n *Node) downloadFrom(ctx context.Context, peer *dht.Node, hash []byte, destPath string) error {
+	tmpPath := partPath(destPath)
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+	defer out.Close()
+
+	// getFile checks every chunk and the Merkle root as the data arrives.
+	if _, err := n.getFile(ctx, peer, hash, out); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, destPath)
+}
+
+// finishDownload re-reads a completed partial file, checks every chunk
+// against the manifest (whose chunk hashes were already matched to the
+// file's Merkle root) and moves the file to destPath.
+func finishDownload(out *os.File, manifest *transfer.Manifest, tmpPath, destPath string) error {
+	for _, info := range manifest.Chunks {
+		data := make([]byte, info.Size)
+		if _, err := out.ReadAt(data, info.Offset); err != nil {
+			return fmt.Errorf("failed to verify chunk %d: %w", info.Index, err)
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], info.Hash) {
+			return fmt.Errorf("content hash mismatch in chunk %d", info.Index)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, destPath)
+}
@@ -0,0 +1,69 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+func (n *Node) newFileServer() *http.Server {
+	// Create a dedicated mux to avoid conflicts in tests
+	mux := http.NewServeMux()
+	mux.HandleFunc(n.fileHandlerPattern, n.handleFileRequest)
+
+	return &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return n.ctx },
+	}
+}
+
+func (n *Node) serveFiles(ln net.Listener) {
+	if err := n.fileServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Printf("File server error: %v", err)
+	}
+}
+
+// handleFileRequest serves a shared file out of the block store. Files are
+// addressed only by their hex content hash, /files/<hash>; nothing in the
+// URL is ever used as a path on disk. http.ServeContent handles Range,
+// If-Range and the conditional headers; the ETag is the content hash, so it
+// never goes stale.
+func (n *Node) handleFileRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash, ok := parseFileID(strings.TrimPrefix(r.URL.Path, n.fileHandlerPattern))
+	if !ok {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+	_, fileInfo, ok := n.fileByHash(hash)
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileInfo.Name}))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(fileInfo.Hash)+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, fileInfo.Name, fileInfo.Added, n.newFileReader(fileInfo))
+}
+
+// parseFileID accepts only the hex encoding of a content hash.
+func parseFileID(id string) ([]byte, bool) {
+	if len(id) != hex.EncodedLen(sha256.Size) {
+		return nil, false
+	}
+	hash, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, false
+	}
+	return hash, true
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"meshfile/internal/dht"
+	"meshfile/internal/transfer"
+	"meshfile/internal/wire"
+	"time"
+)
+
+// GET_FILE asks for a whole file by its hash. The answer is a FILE frame
+// carrying the size and hash, followed by one DATA frame per chunk, or an
+// ERROR frame at any point. The receiver rebuilds the Merkle root from the
+// chunk hashes, so it needs no manifest and no knowledge of the chunker.
+
+func encodeFileHeader(size int64, hash []byte) []byte {
+	var e wire.Encoder
+	e.Uint(uint64(size))
+	e.Bytes(hash)
+	return e.Data()
+}
+
+func decodeFileHeader(payload []byte) (int64, []byte, error) {
+	d := wire.NewDecoder(payload)
+	size, hash := d.Uint(), d.Bytes()
+	if err := d.Err(); err != nil || size > 1<<62 {
+		return 0, nil, fmt.Errorf("invalid FILE response")
+	}
+	return int64(size), hash, nil
+}
+
+// HandleGetFile writes the GET_FILE response to request requestID for the
+// shared file with the given content hash. Problems with the file are sent
+// to the peer as ERROR; only failures to write are returned.
+func (n *Node) HandleGetFile(w io.Writer, requestID uint32, hash []byte) error {
+	write := func(typ wire.Type, payload []byte) error {
+		return wire.WriteFrame(w, &wire.Frame{Type: typ, RequestID: requestID, Payload: payload})
+	}
+
+	_, fileInfo, ok := n.fileByHash(hash)
+	if !ok {
+		return write(wire.TypeError, []byte("file not found"))
+	}
+	if err := write(wire.TypeFile, encodeFileHeader(fileInfo.Size, fileInfo.Hash)); err != nil {
+		return err
+	}
+	for _, chunk := range fileInfo.Chunks {
+		data, err := n.blocks.Get(chunk.Hash)
+		if err != nil {
+			log.Printf("GET_FILE error: %v", err)
+			return write(wire.TypeError, []byte("file unavailable"))
+		}
+		if err := write(wire.TypeData, (&dataResponse{hash: chunk.Hash, data: data}).encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) handleGetFile(w io.Writer, req *wire.Frame) error {
+	hash, err := decodeBytes(req.Payload)
+	if err != nil || len(hash) == 0 {
+		return wire.WriteFrame(w, &wire.Frame{Type: wire.TypeError, RequestID: req.RequestID, Payload: []byte("invalid file hash")})
+	}
+	return n.HandleGetFile(w, req.RequestID, hash)
+}
+
+// getFile downloads the whole shared file with the given hash from peer
+// into w. Every chunk must match the hash it was sent with, the chunk
+// hashes must add up to the requested Merkle root, and exactly the
+// advertised number of bytes must arrive. The stream only times out when
+// the peer goes quiet for rpcTimeout.
+func (n *Node) getFile(ctx context.Context, peer *dht.Node, hash []byte, w io.Writer) (int64, error) {
+	pc, err := n.dialPeer(ctx, peer)
+	if err != nil {
+		return 0, err
+	}
+	defer pc.Close()
+
+	id, err := pc.send(wire.TypeGetFile, encodeBytes(hash))
+	if err != nil {
+		return 0, err
+	}
+	payload, err := pc.receive(id, wire.TypeGetFile, wire.TypeFile)
+	if err != nil {
+		return 0, err
+	}
+	size, fileHash, err := decodeFileHeader(payload)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(fileHash, hash) {
+		return 0, fmt.Errorf("peer sent file %x instead of %x", fileHash, hash)
+	}
+
+	var written int64
+	var chunkHashes [][]byte
+	for written < size {
+		pc.SetDeadline(time.Now().Add(rpcTimeout))
+		payload, err := pc.receive(id, wire.TypeGetFile, wire.TypeData)
+		if err != nil {
+			return written, fmt.Errorf("transfer interrupted after %d of %d bytes: %w", written, size, err)
+		}
+		dr, err := decodeDataResponse(payload)
+		if err != nil {
+			return written, err
+		}
+		if len(dr.data) == 0 || len(dr.data) > transfer.MaxChunkSize || int64(len(dr.data)) > size-written {
+			return written, fmt.Errorf("invalid chunk of %d bytes at offset %d", len(dr.data), written)
+		}
+		if sum := sha256.Sum256(dr.data); !bytes.Equal(sum[:], dr.hash) {
+			return written, fmt.Errorf("chunk at offset %d does not match its hash", written)
+		}
+		if _, err := w.Write(dr.data); err != nil {
+			return written, fmt.Errorf("failed to write file: %w", err)
+		}
+		written += int64(len(dr.data))
+		chunkHashes = append(chunkHashes, dr.hash)
+	}
+
+	if root := transfer.MerkleRoot(chunkHashes); !bytes.Equal(root, hash) {
+		return written, fmt.Errorf("content hash mismatch: got %x", root)
+	}
+	return written, nil
+}
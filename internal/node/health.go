@@ -0,0 +1,211 @@
+package node
+
+import (
+	"context"
+	"log"
+	"meshfile/internal/dht"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthInterval = 15 * time.Second
+	healthPingTimeout     = 5 * time.Second
+	deadAfterFailures     = 3 // consecutive failed pings before a peer is evicted
+	peerEventBuffer       = 32
+)
+
+type PeerState string
+
+const (
+	PeerAlive   PeerState = "alive"
+	PeerSuspect PeerState = "suspect" // the last ping failed
+	PeerDead    PeerState = "dead"    // evicted after deadAfterFailures failures
+)
+
+// PeerEvent reports a peer changing state.
+type PeerEvent struct {
+	Address  string
+	ID       []byte
+	From     PeerState
+	To       PeerState
+	RTT      time.Duration
+	Failures int
+	Time     time.Time
+}
+
+// peerEvents fans peer events out to subscribers. Slow subscribers miss
+// events rather than stall the health checker.
+type peerEvents struct {
+	mu   sync.Mutex
+	subs map[chan PeerEvent]struct{}
+}
+
+// SubscribePeerEvents returns a channel of peer state changes and a
+// function that ends the subscription.
+func (n *Node) SubscribePeerEvents() (<-chan PeerEvent, func()) {
+	ch := make(chan PeerEvent, peerEventBuffer)
+
+	n.events.mu.Lock()
+	if n.events.subs == nil {
+		n.events.subs = make(map[chan PeerEvent]struct{})
+	}
+	n.events.subs[ch] = struct{}{}
+	n.events.mu.Unlock()
+
+	return ch, func() {
+		n.events.mu.Lock()
+		defer n.events.mu.Unlock()
+		if _, ok := n.events.subs[ch]; ok {
+			delete(n.events.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (n *Node) publishPeerEvent(ev PeerEvent) {
+	log.Printf("Peer %s is %s (was %s, %d failures)", ev.Address, ev.To, ev.From, ev.Failures)
+
+	n.events.mu.Lock()
+	defer n.events.mu.Unlock()
+	for ch := range n.events.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// addPeerContact records a peer that just answered us.
+func (n *Node) addPeerContact(contact *dht.Node) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	peer, ok := n.peers[contact.Address]
+	if !ok {
+		peer = &Peer{Address: contact.Address, State: PeerAlive}
+		n.peers[contact.Address] = peer
+	}
+	if contact.ID != nil {
+		peer.ID = contact.ID
+	}
+	peer.LastSeen = time.Now()
+}
+
+// startHealthChecker pings every known peer on a schedule until the node
+// stops.
+func (n *Node) startHealthChecker() {
+	interval := n.config.HealthInterval
+	if interval <= 0 {
+		interval = defaultHealthInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.checkPeers()
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// checkPeers pings all peers in parallel and applies the results.
+func (n *Node) checkPeers() {
+	var wg sync.WaitGroup
+	for _, peer := range n.ListPeers() {
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, healthPingTimeout)
+			defer cancel()
+
+			start := time.Now()
+			contact, err := n.ping(ctx, &dht.Node{ID: peer.ID, Address: peer.Address})
+			if err != nil {
+				if n.ctx.Err() != nil {
+					return
+				}
+				log.Printf("Health check of %s failed: %v", peer.Address, err)
+				n.recordPingFailure(peer.Address)
+				return
+			}
+			n.dht.AddNode(contact)
+			n.recordPingSuccess(peer.Address, contact.ID, time.Since(start))
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (n *Node) recordPingSuccess(address string, id []byte, rtt time.Duration) {
+	n.mu.Lock()
+	peer, ok := n.peers[address]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	from := peer.State
+	peer.ID = id
+	peer.LastSeen = time.Now()
+	peer.Failures = 0
+	peer.State = PeerAlive
+	if peer.RTT == 0 {
+		peer.RTT = rtt
+	} else {
+		// Smooth like TCP's SRTT so one slow ping does not dominate.
+		peer.RTT = (7*peer.RTT + rtt) / 8
+	}
+	ev := PeerEvent{Address: address, ID: id, From: from, To: PeerAlive, RTT: peer.RTT, Time: peer.LastSeen}
+	n.mu.Unlock()
+
+	if from != PeerAlive {
+		n.publishPeerEvent(ev)
+	}
+}
+
+func (n *Node) recordPingFailure(address string) {
+	n.mu.Lock()
+	peer, ok := n.peers[address]
+	if !ok {
+		n.mu.Unlock()
+		return
+	}
+	from := peer.State
+	peer.Failures++
+	peer.State = PeerSuspect
+	if peer.Failures >= deadAfterFailures {
+		peer.State = PeerDead
+		delete(n.peers, address)
+	}
+	ev := PeerEvent{
+		Address:  address,
+		ID:       peer.ID,
+		From:     from,
+		To:       peer.State,
+		RTT:      peer.RTT,
+		Failures: peer.Failures,
+		Time:     time.Now(),
+	}
+	n.mu.Unlock()
+
+	if ev.To == PeerDead {
+		// The peer may have been added by address only, so drop every
+		// contact at that address as well.
+		if ev.ID != nil {
+			n.dht.RemoveNode(ev.ID)
+		}
+		for _, contact := range n.dht.AllNodes() {
+			if contact.Address == address {
+				n.dht.RemoveNode(contact.ID)
+			}
+		}
+		if n.pool != nil {
+			n.pool.drop(address)
+		}
+	}
+	if ev.To != from {
+		n.publishPeerEvent(ev)
+	}
+}
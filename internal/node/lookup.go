@@ -0,0 +1,158 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"meshfile/internal/dht"
+	"time"
+)
+
+const lookupAlpha = 3 // concurrent requests per lookup round
+
+type lookupCandidate struct {
+	node    *dht.Node
+	queried bool
+	failed  bool
+}
+
+// lookupState is the shortlist of an iterative lookup, kept sorted by
+// distance to the target.
+type lookupState struct {
+	target     []byte
+	localID    []byte
+	candidates []*lookupCandidate
+	seen       map[string]bool
+}
+
+type lookupResult struct {
+	candidate *lookupCandidate
+	nodes     []*dht.Node
+	stop      bool
+	err       error
+}
+
+// lookupQuery asks a single contact about the lookup target. It returns
+// the contacts the peer suggested and whether the lookup can stop early.
+type lookupQuery func(ctx context.Context, contact *dht.Node) ([]*dht.Node, bool, error)
+
+// Lookup runs an iterative Kademlia FIND_NODE for target, querying up to
+// lookupAlpha peers at a time until the K closest contacts seen so far have
+// all been asked. It returns the closest contacts that answered.
+func (n *Node) Lookup(ctx context.Context, target []byte) ([]*dht.Node, error) {
+	if n.dht == nil {
+		return nil, errNotStarted
+	}
+	target = dht.KeyID(target)
+	return n.iterativeLookup(ctx, target, func(ctx context.Context, contact *dht.Node) ([]*dht.Node, bool, error) {
+		nodes, err := n.findNode(ctx, contact, target)
+		return nodes, false, err
+	})
+}
+
+func (n *Node) iterativeLookup(ctx context.Context, target []byte, query lookupQuery) ([]*dht.Node, error) {
+	seeds := n.dht.FindClosestNodes(target, dht.K)
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("no known nodes to start lookup")
+	}
+
+	state := &lookupState{
+		target:  target,
+		localID: n.dht.LocalID,
+		seen:    make(map[string]bool),
+	}
+	state.merge(seeds)
+
+	for done := false; !done; {
+		batch := state.next(lookupAlpha)
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan lookupResult, len(batch))
+		for _, c := range batch {
+			c.queried = true
+			go func(c *lookupCandidate) {
+				nodes, stop, err := query(ctx, c.node)
+				results <- lookupResult{candidate: c, nodes: nodes, stop: stop, err: err}
+			}(c)
+		}
+
+		for range batch {
+			res := <-results
+			if res.err != nil {
+				res.candidate.failed = true
+				continue
+			}
+			res.candidate.node.LastSeen = time.Now()
+			n.dht.AddNode(res.candidate.node)
+			state.merge(res.nodes)
+			done = done || res.stop
+		}
+
+		if err := ctx.Err(); err != nil {
+			return state.closest(), err
+		}
+	}
+
+	return state.closest(), nil
+}
+
+func (s *lookupState) merge(nodes []*dht.Node) {
+	for _, node := range nodes {
+		if node == nil || len(node.ID) != dht.IDLength || node.Address == "" {
+			continue
+		}
+		if bytes.Equal(node.ID, s.localID) || s.seen[string(node.ID)] {
+			continue
+		}
+		s.seen[string(node.ID)] = true
+		s.candidates = append(s.candidates, &lookupCandidate{node: node})
+	}
+
+	nodeList := make([]*dht.Node, len(s.candidates))
+	byNode := make(map[*dht.Node]*lookupCandidate, len(s.candidates))
+	for i, c := range s.candidates {
+		nodeList[i] = c.node
+		byNode[c.node] = c
+	}
+	dht.SortByDistance(nodeList, s.target)
+	for i, node := range nodeList {
+		s.candidates[i] = byNode[node]
+	}
+}
+
+// next returns up to limit unqueried candidates among the K closest live
+// ones. An empty result means the lookup has converged.
+func (s *lookupState) next(limit int) []*lookupCandidate {
+	var batch []*lookupCandidate
+	live := 0
+	for _, c := range s.candidates {
+		if c.failed {
+			continue
+		}
+		if live++; live > dht.K {
+			break
+		}
+		if !c.queried {
+			batch = append(batch, c)
+			if len(batch) == limit {
+				break
+			}
+		}
+	}
+	return batch
+}
+
+func (s *lookupState) closest() []*dht.Node {
+	var nodes []*dht.Node
+	for _, c := range s.candidates {
+		if c.queried && !c.failed {
+			nodes = append(nodes, c.node)
+			if len(nodes) == dht.K {
+				break
+			}
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,162 @@
+package node
+
+import (
+	"fmt"
+	"meshfile/internal/dht"
+	"meshfile/internal/wire"
+	"time"
+)
+
+// Payload encodings for the peer protocol messages. Contacts are sent as
+// ID and address; LastSeen is local bookkeeping and not transmitted.
+
+func encodeContact(e *wire.Encoder, contact *dht.Node) {
+	e.Bytes(contact.ID)
+	e.Text(contact.Address)
+}
+
+func decodeContact(d *wire.Decoder) *dht.Node {
+	return &dht.Node{ID: d.Bytes(), Address: d.Text()}
+}
+
+func encodeContacts(contacts []*dht.Node) []byte {
+	var e wire.Encoder
+	e.Uint(uint64(len(contacts)))
+	for _, contact := range contacts {
+		encodeContact(&e, contact)
+	}
+	return e.Data()
+}
+
+func decodeContacts(d *wire.Decoder) []*dht.Node {
+	var contacts []*dht.Node
+	for i := d.Count(2); i > 0; i-- {
+		contacts = append(contacts, decodeContact(d))
+	}
+	return contacts
+}
+
+// storeRequest is the STORE payload. The TTL is relative so that clock
+// skew between peers does not affect expiry.
+type storeRequest struct {
+	Key        []byte
+	NodeID     []byte
+	Address    string
+	TTLSeconds int64
+}
+
+func (req *storeRequest) encode() []byte {
+	var e wire.Encoder
+	e.Bytes(req.Key)
+	e.Bytes(req.NodeID)
+	e.Text(req.Address)
+	e.Uint(uint64(req.TTLSeconds))
+	return e.Data()
+}
+
+func decodeStoreRequest(payload []byte) (*storeRequest, error) {
+	d := wire.NewDecoder(payload)
+	req := &storeRequest{Key: d.Bytes(), NodeID: d.Bytes(), Address: d.Text()}
+	ttl := d.Uint()
+	if err := d.Err(); err != nil || ttl > uint64(dht.ProviderTTL/time.Second) {
+		return nil, fmt.Errorf("invalid STORE request")
+	}
+	req.TTLSeconds = int64(ttl)
+	return req, nil
+}
+
+// findValueResponse carries the providers of a key or, if there are none,
+// the contacts closest to it. Provider expiry is sent as a relative TTL.
+type findValueResponse struct {
+	Providers []*dht.ProviderRecord
+	Nodes     []*dht.Node
+}
+
+func (value *findValueResponse) encode() []byte {
+	var e wire.Encoder
+	e.Uint(uint64(len(value.Providers)))
+	for _, rec := range value.Providers {
+		e.Bytes(rec.NodeID)
+		e.Text(rec.Address)
+		e.Uint(uint64(max(time.Until(rec.Expires)/time.Second, 0)))
+	}
+	nodes := encodeContacts(value.Nodes)
+	return append(e.Data(), nodes...)
+}
+
+func decodeFindValueResponse(key, payload []byte) (*findValueResponse, error) {
+	d := wire.NewDecoder(payload)
+	value := &findValueResponse{}
+	now := time.Now()
+	for i := d.Count(3); i > 0; i-- {
+		rec := &dht.ProviderRecord{Key: key, NodeID: d.Bytes(), Address: d.Text()}
+		rec.Expires = now.Add(time.Duration(min(d.Uint(), uint64(dht.ProviderTTL/time.Second))) * time.Second)
+		value.Providers = append(value.Providers, rec)
+	}
+	value.Nodes = decodeContacts(d)
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("invalid VALUE response: %w", err)
+	}
+	return value, nil
+}
+
+// dataResponse is the DATA payload answering GET_MANIFEST and GET_CHUNK:
+// the hash the data is identified by, an optional Merkle inclusion proof
+// and the data itself.
+type dataResponse struct {
+	hash  []byte
+	proof [][]byte
+	data  []byte
+}
+
+func (dr *dataResponse) encode() []byte {
+	var e wire.Encoder
+	e.Bytes(dr.hash)
+	e.Uint(uint64(len(dr.proof)))
+	for _, sibling := range dr.proof {
+		e.Bytes(sibling)
+	}
+	e.Bytes(dr.data)
+	return e.Data()
+}
+
+func decodeDataResponse(payload []byte) (*dataResponse, error) {
+	d := wire.NewDecoder(payload)
+	dr := &dataResponse{hash: d.Bytes()}
+	for i := d.Count(1); i > 0; i-- {
+		dr.proof = append(dr.proof, d.Bytes())
+	}
+	dr.data = d.Bytes()
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("invalid DATA response: %w", err)
+	}
+	return dr, nil
+}
+
+func encodeChunkRequest(hash []byte, index uint64) []byte {
+	var e wire.Encoder
+	e.Bytes(hash)
+	e.Uint(index)
+	return e.Data()
+}
+
+func decodeChunkRequest(payload []byte) ([]byte, uint64, error) {
+	d := wire.NewDecoder(payload)
+	hash, index := d.Bytes(), d.Uint()
+	if err := d.Err(); err != nil {
+		return nil, 0, fmt.Errorf("invalid GET_CHUNK request")
+	}
+	return hash, index, nil
+}
+
+func encodeBytes(b []byte) []byte {
+	var e wire.Encoder
+	e.Bytes(b)
+	return e.Data()
+}
+
+func decodeBytes(payload []byte) ([]byte, error) {
+	d := wire.NewDecoder(payload)
+	b := d.Bytes()
+	return b, d.Err()
+}
@@ -7,27 +7,49 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/gob"
-	"encoding/json"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"meshfile/internal/crypto"
 	"meshfile/internal/dht"
+	"meshfile/internal/discovery"
+	"meshfile/internal/mux"
+	"meshfile/internal/store"
 	"meshfile/internal/transfer"
+	"meshfile/internal/wire"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"path/filepath"
 	"sort"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	dialTimeout = 5 * time.Second
+	rpcTimeout  = 10 * time.Second
+)
+
+var errNotStarted = errors.New("node is not started")
+
 type Config struct {
-	Port      int
-	WebUIPort int
+	Port           int
+	ListenAddr     string // DHT bind address; empty listens on Port on all interfaces
+	AdvertiseAddr  string // address other nodes should dial; empty derives it
+	FileServerPort int
+	BootstrapPeers []string
+	Chunker        transfer.Chunker // nil selects fixed-size chunks
+	DataDir        string           // where shared data and state are kept; empty uses a temporary directory
+	IdentityPath   string           // empty uses a throwaway identity
+	HealthInterval time.Duration    // how often peers are pinged; 0 uses the default
+	LANDiscovery   bool             // announce and find nodes by UDP multicast
+	LANGroup       string           // multicast group; empty uses discovery.DefaultGroup
+	LANInterface   string           // interface for multicast; empty lets the system choose
 }
 
 type Node struct {
@@ -36,21 +58,44 @@ type Node struct {
 	files              map[string]*FileInfo
 	privateKey         *rsa.PrivateKey
 	encryptor          *crypto.Encryptor
+	identity           *crypto.Identity
+	tlsCert            tls.Certificate
 	dht                *dht.DHT
+	pool               *sessionPool
+	inbound            atomic.Int32
+	events             peerEvents
+	lan                *discovery.Service
+	observed           map[string]string // reporting peer ID -> IP it saw us at
 	mu                 sync.RWMutex
 	fileServer         *http.Server
+	listener           net.Listener
+	fileAddr           net.Addr
+	inboundSessions    map[*mux.Session]struct{}
+	ctx                context.Context // cancelled when the node stops
+	cancel             context.CancelFunc
+	wg                 sync.WaitGroup
+	blocks             *store.Store
+	tempDataDir        string
+	saveMu             sync.Mutex // serializes writes of the state file
 	fileHandlerPattern string
 }
 
 type Peer struct {
 	Address  string
+	ID       []byte // nil until the peer has answered a ping
 	LastSeen time.Time
+	State    PeerState
+	RTT      time.Duration // smoothed ping round-trip time
+	Failures int           // consecutive failed health checks
 }
 
 type FileInfo struct {
-	Name string
-	Size int64
-	Hash []byte
+	Name   string
+	Size   int64
+	Hash   []byte // Merkle root over the chunk hashes
+	Chunks []transfer.ChunkInfo
+	Added  time.Time // when the file was shared; served as Last-Modified
+	tree   *transfer.MerkleTree
 }
 
 func NewNode(config *Config) *Node {
@@ -62,34 +107,159 @@ func NewNode(config *Config) *Node {
 	}
 }
 
-func (n *Node) Start() error {
+// Start binds the DHT service and file server and launches the node's
+// background work. Everything runs until ctx is cancelled or Stop is
+// called.
+func (n *Node) Start(ctx context.Context) error {
 	if err := n.initializeSecurity(); err != nil {
 		return err
 	}
+	if err := n.openBlockStore(); err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", n.listenAddress())
+	if err != nil {
+		n.removeTempDataDir()
+		return fmt.Errorf("failed to start DHT service: %w", err)
+	}
+	fileLn, err := net.Listen("tcp", fmt.Sprintf(":%d", n.config.FileServerPort))
+	if err != nil {
+		ln.Close()
+		n.removeTempDataDir()
+		return fmt.Errorf("failed to start file server: %w", err)
+	}
+
+	n.dht = dht.NewDHTWithID(dht.IDFromPublicKey(n.identity.PublicKey()))
+	n.dht.SetPinger(n.pingContact)
+	n.pool = newSessionPool(n.dialSession)
+	n.ctx, n.cancel = context.WithCancel(ctx)
+	n.listener = ln
+	n.fileAddr = fileLn.Addr()
+	n.fileServer = n.newFileServer()
+
+	if err := n.loadState(); err != nil {
+		ln.Close()
+		fileLn.Close()
+		n.cancel()
+		n.cancel = nil
+		// Without a block store the node is not persistent, so nothing
+		// saves an empty state over the file that failed to load.
+		n.blocks = nil
+		n.removeTempDataDir()
+		return err
+	}
+
+	log.Printf("DHT service listening on %s", ln.Addr())
+	log.Printf("File server listening on %s", fileLn.Addr())
+
+	n.spawn(func() { n.serveDHT(ln) })
+	n.spawn(func() { n.serveFiles(fileLn) })
+	n.spawn(n.startDiscovery)
+	n.spawn(n.startRepublisher)
+	n.spawn(n.startHealthChecker)
+	if n.persistent() {
+		n.spawn(n.startStateSaver)
+	}
+	if n.GetFileCount() > 0 {
+		n.spawn(n.announceFiles)
+	}
 
-	n.dht = dht.NewDHT(fmt.Sprintf("localhost:%d", n.config.Port))
+	if len(n.config.BootstrapPeers) > 0 {
+		n.spawn(n.bootstrap)
+	}
 
-	go n.startDHTService()
-	go n.startFileServer()
-	go n.startDiscovery()
+	if n.config.LANDiscovery {
+		n.startLANDiscovery()
+	}
 
+	n.spawn(func() {
+		<-n.ctx.Done()
+		n.shutdown()
+	})
 	return nil
 }
 
+// track registers an operation run on the caller's goroutine with the
+// WaitGroup Stop waits on. It fails once the node is stopping; holding n.mu
+// orders the check against Stop cancelling the context, so no Add can race
+// with Stop's Wait.
+func (n *Node) track() (done func(), err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ctx == nil {
+		return nil, errNotStarted
+	}
+	if err := n.ctx.Err(); err != nil {
+		return nil, fmt.Errorf("node stopped: %w", err)
+	}
+	n.wg.Add(1)
+	return n.wg.Done, nil
+}
+
+// spawn runs fn in a goroutine that Stop waits for.
+func (n *Node) spawn(fn func()) {
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		fn()
+	}()
+}
+
+// Stop cancels the node's context and waits until every listener,
+// background loop and connection handler has returned.
 func (n *Node) Stop() {
+	if n.cancel != nil {
+		n.mu.Lock()
+		n.cancel()
+		n.mu.Unlock()
+		n.wg.Wait()
+		if err := n.saveState(); err != nil {
+			log.Printf("Failed to save state: %v", err)
+		}
+	}
 	n.cleanup()
+	// The store's directory may be about to go; nothing may write to it.
+	n.mu.Lock()
+	n.blocks = nil
+	n.mu.Unlock()
+	n.removeTempDataDir()
 
-	// Shutdown the file server if it exists
-	if n.fileServer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+	fmt.Printf("Node stopped, PORT: %s \n", n.listenPort())
+}
 
-		if err := n.fileServer.Shutdown(ctx); err != nil {
-			log.Printf("Error shutting down file server: %v", err)
-		}
+// shutdown closes everything that keeps the node's goroutines blocked.
+func (n *Node) shutdown() {
+	n.listener.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.fileServer.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down file server: %v", err)
 	}
 
-	fmt.Printf("Node stopped, PORT: %d \n", n.config.Port)
+	n.pool.closeAll()
+	if n.lan != nil {
+		n.lan.Close()
+	}
+
+	n.mu.Lock()
+	for session := range n.inboundSessions {
+		session.Close()
+	}
+	n.mu.Unlock()
+}
+
+// sleep waits for d and reports whether the node is still running.
+func (n *Node) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-n.ctx.Done():
+		return false
+	}
 }
 
 func (n *Node) initializeSecurity() error {
@@ -99,168 +269,235 @@ func (n *Node) initializeSecurity() error {
 	}
 	n.encryptor = enc
 	n.privateKey = enc.GetPrivateKey() // Corrected line
-	return nil
-}
 
-func (n *Node) startDHTService() {
-	addr := fmt.Sprintf(":%d", n.config.Port)
-	ln, err := net.Listen("tcp", addr)
+	if n.config.IdentityPath != "" {
+		n.identity, err = crypto.LoadOrCreateIdentity(n.config.IdentityPath)
+	} else if n.config.DataDir != "" {
+		n.identity, err = crypto.LoadOrCreateIdentity(filepath.Join(n.config.DataDir, "identity.pem"))
+	} else {
+		n.identity, err = crypto.NewIdentity()
+	}
 	if err != nil {
-		log.Fatalf("Failed to start DHT service: %v", err)
+		return err
 	}
-	defer ln.Close()
-
-	log.Printf("DHT service listening on %s", addr)
+	return n.initializeTLS()
+}
 
+func (n *Node) serveDHT(ln net.Listener) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if n.ctx.Err() != nil {
+				return
+			}
 			log.Printf("Failed to accept connection: %v", err)
+			if !n.sleep(100 * time.Millisecond) {
+				return
+			}
 			continue
 		}
-		go n.handleDHTConnection(conn)
-	}
-}
-
-func (n *Node) startFileServer() {
-	// Use WebUIPort (instead of config.Port+1) for the file server
-	addr := fmt.Sprintf(":%d", n.config.WebUIPort)
-
-	// Create a dedicated mux to avoid conflicts in tests
-	mux := http.NewServeMux()
-	mux.HandleFunc(n.fileHandlerPattern, n.handleFileRequest)
-
-	log.Printf("File server listening on %s", addr)
-
-	server := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+		n.spawn(func() { n.handleDHTConnection(conn) })
 	}
-	n.fileServer = server
-
-	// Launch the file server
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("File server ListenAndServe error: %v", err)
-		}
-	}()
 }
 
-func (n *Node) handleDHTConnection(conn net.Conn) {
-	defer conn.Close()
+// handleDHTConnection authenticates an incoming connection and serves the
+// streams the peer opens on it until the session closes. The first stream
+// must carry the HELLO exchange.
+func (n *Node) handleDHTConnection(rawConn net.Conn) {
+	defer rawConn.Close()
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("Recovered from panic in DHT connection: %v", r)
 		}
 		//n.cleanup()
 	}()
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	for {
-		op, err := rw.ReadString('\n')
-		if err != nil {
-			log.Printf("DHT read error: %v", err)
-			return
-		}
-		op = strings.TrimSpace(op)
-
-		switch op {
-		case "PING":
-			n.handlePing(rw)
-		case "FIND_NODE":
-			n.handleFindNode(rw)
-		default:
-			log.Printf("DHT unknown operation: %s", op)
-			return
-		}
+	if n.inbound.Add(1) > maxInboundSessions {
+		n.inbound.Add(-1)
+		log.Printf("Rejected connection from %s: too many sessions", rawConn.RemoteAddr())
+		return
 	}
-}
+	defer n.inbound.Add(-1)
 
-func (n *Node) handlePing(rw *bufio.ReadWriter) {
-	_, err := rw.WriteString("PONG\n")
+	conn, peerID, err := n.secureServer(rawConn)
 	if err != nil {
-		log.Printf("DHT write error: %v", err)
+		log.Printf("Rejected connection from %s: %v", rawConn.RemoteAddr(), err)
 		return
 	}
-	err = rw.Flush()
-	if err != nil {
-		log.Printf("DHT flush error: %v", err)
+	// The dialing side closes idle sessions first, so it never reuses one
+	// that is about to be closed here.
+	session := mux.Server(conn, muxConfig(2*sessionIdleTimeout))
+	defer session.Close()
+	if !n.trackSession(session) {
 		return
 	}
-}
+	defer n.untrackSession(session)
 
-func (n *Node) handleFindNode(rw *bufio.ReadWriter) {
-	targetIDStr, err := rw.ReadString('\n')
+	stream, err := session.Accept()
 	if err != nil {
-		log.Printf("DHT read error: %v", err)
 		return
 	}
-	targetIDStr = strings.TrimSpace(targetIDStr)
-	var targetID []byte
-	err = json.Unmarshal([]byte(targetIDStr), &targetID)
+	stream.SetDeadline(time.Now().Add(dialTimeout))
+	err = n.acceptHello(bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream)))
+	stream.Close()
 	if err != nil {
-		log.Printf("DHT unmarshal error: %v", err)
+		log.Printf("Rejected connection from %s: %v", rawConn.RemoteAddr(), err)
 		return
 	}
 
-	closestNodes := n.dht.FindClosestNodes(targetID, 5)
-	respBytes, err := json.Marshal(closestNodes)
-	if err != nil {
-		log.Printf("DHT marshal error: %v", err)
-		return
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		n.spawn(func() { n.serveStream(peerID, rawConn.RemoteAddr(), stream) })
 	}
+}
 
-	_, err = rw.WriteString(string(respBytes) + "\n")
-	if err != nil {
-		log.Printf("DHT write error: %v", err)
-		return
+// trackSession registers an inbound session so shutdown can close it. It
+// reports false if the node is already shutting down.
+func (n *Node) trackSession(session *mux.Session) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ctx.Err() != nil {
+		return false
 	}
-	err = rw.Flush()
-	if err != nil {
-		log.Printf("DHT flush error: %v", err)
-		return
+	if n.inboundSessions == nil {
+		n.inboundSessions = make(map[*mux.Session]struct{})
 	}
+	n.inboundSessions[session] = struct{}{}
+	return true
 }
 
-func (n *Node) handleFileRequest(w http.ResponseWriter, r *http.Request) {
+func (n *Node) untrackSession(session *mux.Session) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.inboundSessions, session)
+}
+
+// serveStream answers requests on one stream until the peer closes it.
+func (n *Node) serveStream(peerID []byte, remote net.Addr, stream *mux.Stream) {
+	defer stream.Close()
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered from panic in file request: %v", r)
+			log.Printf("Recovered from panic in DHT stream: %v", r)
 		}
-		//n.cleanup()
 	}()
-	filePath := r.URL.Path[len("/files/"):]
-	if filePath == "" {
-		http.Error(w, "File path is required", http.StatusBadRequest)
-		return
-	}
 
-	decodedPath, err := url.QueryUnescape(filePath)
-	if err != nil {
-		http.Error(w, "Invalid file path", http.StatusBadRequest)
-		return
+	rw := bufio.NewReadWriter(bufio.NewReader(stream), bufio.NewWriter(stream))
+	for {
+		req, err := wire.ReadFrame(rw)
+		if err != nil {
+			if err != io.EOF && err != mux.ErrSessionClosed {
+				log.Printf("DHT read error: %v", err)
+			}
+			return
+		}
+
+		if req.Type == wire.TypeGetFile {
+			// GET_FILE is answered with a stream of frames.
+			err = n.handleGetFile(rw, req)
+		} else {
+			typ, payload, herr := n.handleRequest(peerID, remote, req)
+			if herr != nil {
+				typ, payload = wire.TypeError, []byte(herr.Error())
+			}
+			err = wire.WriteFrame(rw, &wire.Frame{Type: typ, RequestID: req.RequestID, Payload: payload})
+		}
+		if err == nil {
+			err = rw.Flush()
+		}
+		if err != nil {
+			log.Printf("DHT write error: %v", err)
+			return
+		}
 	}
+}
 
-	file, err := os.Open(decodedPath)
+// acceptHello expects HELLO as the first message and answers with the
+// highest version both sides speak.
+func (n *Node) acceptHello(rw *bufio.ReadWriter) error {
+	req, err := wire.ReadFrame(rw)
 	if err != nil {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
+		return fmt.Errorf("failed to read HELLO: %w", err)
+	}
+	if req.Type != wire.TypeHello {
+		return fmt.Errorf("expected HELLO, got %s", req.Type)
 	}
-	defer file.Close()
 
-	fileInfo, err := file.Stat()
+	local := localHello()
+	reply := &wire.Frame{Type: wire.TypeHello, RequestID: req.RequestID}
+	remote, err := wire.DecodeHello(req.Payload)
+	var version uint64
+	if err == nil {
+		version, err = wire.Negotiate(local, remote)
+	}
 	if err != nil {
-		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
-		return
+		reply.Type, reply.Payload = wire.TypeError, []byte(err.Error())
+	} else {
+		reply.Payload = (&wire.Hello{MinVersion: version, MaxVersion: version, Capabilities: local.Capabilities}).Encode()
+	}
+
+	if werr := wire.WriteFrame(rw, reply); werr != nil {
+		return werr
+	}
+	if werr := rw.Flush(); werr != nil {
+		return werr
+	}
+	return err
+}
+
+// handleRequest dispatches one request and returns the response. Errors
+// are sent back as ERROR and leave the connection usable.
+func (n *Node) handleRequest(peerID []byte, remote net.Addr, req *wire.Frame) (wire.Type, []byte, error) {
+	switch req.Type {
+	case wire.TypePing:
+		return n.handlePing(peerID, remote, req.Payload)
+	case wire.TypeFindNode:
+		return n.handleFindNode(req.Payload)
+	case wire.TypeStore:
+		return n.handleStore(peerID, req.Payload)
+	case wire.TypeFindValue:
+		return n.handleFindValue(req.Payload)
+	case wire.TypeGetManifest:
+		return n.handleGetManifest(req.Payload)
+	case wire.TypeGetChunk:
+		return n.handleGetChunk(req.Payload)
+	default:
+		return 0, nil, fmt.Errorf("unsupported message type %s", req.Type)
+	}
+}
+
+// handlePing only records the sender if the contact it reports carries the
+// ID it authenticated with. PONG tells the sender which address its
+// connection came from.
+func (n *Node) handlePing(peerID []byte, remote net.Addr, payload []byte) (wire.Type, []byte, error) {
+	d := wire.NewDecoder(payload)
+	sender := decodeContact(d)
+	if err := d.Err(); err != nil {
+		return 0, nil, fmt.Errorf("invalid PING request")
+	}
+	sender.Address = reachableAddress(sender.Address, remote)
+	if bytes.Equal(sender.ID, peerID) {
+		sender.LastSeen = time.Now()
+		n.dht.AddNode(sender)
+		n.UpdatePeerLastSeen(sender.Address)
+	} else {
+		log.Printf("PING contact %x does not match peer identity %x", sender.ID, peerID)
 	}
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+fileInfo.Name())
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	var e wire.Encoder
+	encodeContact(&e, n.self())
+	e.Text(remote.String())
+	return wire.TypePong, e.Data(), nil
+}
 
-	_, err = io.Copy(w, file)
+func (n *Node) handleFindNode(payload []byte) (wire.Type, []byte, error) {
+	target, err := decodeBytes(payload)
 	if err != nil {
-		log.Printf("File copy error: %v", err)
+		return 0, nil, fmt.Errorf("invalid FIND_NODE request")
 	}
+	closestNodes := n.dht.FindClosestNodes(target, dht.K)
+	return wire.TypeNodes, encodeContacts(closestNodes), nil
 }
 
 func (n *Node) startDiscovery() {
@@ -273,59 +510,121 @@ func (n *Node) startDiscovery() {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			return
+		}
 		knownNodes := n.dht.FindClosestNodes(n.dht.LocalID, 5)
 		for _, node := range knownNodes {
-			if node.Address == fmt.Sprintf("localhost:%d", n.config.Port) {
+			if bytes.Equal(node.ID, n.dht.LocalID) {
 				continue
 			}
-			go n.attemptPeerConnection(node.Address)
+			n.spawn(func() { n.attemptPeerConnection(node) })
 		}
 	}
 }
 
-func (n *Node) attemptPeerConnection(address string) {
-	conn, err := net.Dial("tcp", address)
+// startLANDiscovery announces this node on the local network. Failing to
+// join the multicast group is not fatal; the node still works through
+// bootstrap peers.
+func (n *Node) startLANDiscovery() {
+	config := &discovery.Config{Group: n.config.LANGroup, Interface: n.config.LANInterface}
+	port, err := strconv.Atoi(n.listenPort())
 	if err != nil {
-		log.Printf("Failed to connect to peer %s: %v", address, err)
+		log.Printf("LAN discovery disabled: invalid listen port %s", n.listenPort())
 		return
 	}
-	defer conn.Close()
-	defer func() { /* cleanup */ }()
+	lan, err := discovery.Start(n.dht.LocalID, port, config, n.handleLANPeer)
+	if err != nil {
+		log.Printf("LAN discovery disabled: %v", err)
+		return
+	}
+	n.lan = lan
+}
 
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+// handleLANPeer connects to a node heard on the LAN unless it is already
+// in the routing table. The ping verifies the announced ID.
+func (n *Node) handleLANPeer(peer discovery.Peer) {
+	if _, ok := n.dht.GetNode(peer.ID); ok {
+		return
+	}
+	n.spawn(func() { n.attemptPeerConnection(&dht.Node{ID: peer.ID, Address: peer.Address}) })
+}
 
-	_, err = rw.WriteString("PING\n")
+func (n *Node) attemptPeerConnection(peer *dht.Node) {
+	contact, err := n.ping(n.ctx, peer)
 	if err != nil {
-		log.Printf("Peer write error: %v", err)
+		if n.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Failed to ping peer %s: %v", peer.Address, err)
 		return
 	}
-	err = rw.Flush()
+	log.Printf("Successfully pinged peer %s", peer.Address)
+	n.dht.AddNode(contact)
+	n.addPeerContact(contact)
+}
+
+// ping exchanges contacts with peer and returns the contact it reported
+// for itself, which must carry the ID the peer authenticated with.
+func (n *Node) ping(ctx context.Context, peer *dht.Node) (*dht.Node, error) {
+	pc, err := n.dialPeer(ctx, peer)
 	if err != nil {
-		log.Printf("Peer flush error: %v", err)
-		return
+		return nil, err
 	}
+	defer pc.Close()
 
-	resp, err := rw.ReadString('\n')
+	var e wire.Encoder
+	encodeContact(&e, n.self())
+	payload, err := pc.request(wire.TypePing, e.Data(), wire.TypePong)
 	if err != nil {
-		log.Printf("Peer read error: %v", err)
-		return
+		return nil, err
 	}
-	resp = strings.TrimSpace(resp)
 
-	if resp == "PONG" {
-		log.Printf("Successfully pinged peer %s", address)
-		n.AddPeer(address)
+	d := wire.NewDecoder(payload)
+	contact := decodeContact(d)
+	observed := d.Text()
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("invalid PONG contact: %w", err)
+	}
+	if !bytes.Equal(contact.ID, pc.remoteID) {
+		return nil, fmt.Errorf("PONG contact %x does not match peer identity %x", contact.ID, pc.remoteID)
+	}
+	n.recordObserved(observed, pc.remoteID)
+	if contact.Address == "" {
+		contact.Address = peer.Address
+	}
+	contact.Address = reachableAddress(contact.Address, pc.RemoteAddr())
+	contact.LastSeen = time.Now()
+	return contact, nil
+}
+
+// pingContact is the DHT's liveness check for full buckets.
+func (n *Node) pingContact(contact *dht.Node) bool {
+	_, err := n.ping(n.ctx, contact)
+	return err == nil
+}
+
+func (n *Node) self() *dht.Node {
+	return &dht.Node{
+		ID:      n.dht.LocalID,
+		Address: n.advertisedAddress(),
 	}
 }
 
 func (n *Node) AddPeer(address string) {
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	n.peers[address] = &Peer{Address: address, LastSeen: time.Now()}
+	n.addPeerContact(&dht.Node{Address: address})
 }
 
 func (n *Node) AddFile(filePath string) error {
+	n.mu.RLock()
+	started := n.blocks != nil
+	n.mu.RUnlock()
+	if !started {
+		return errNotStarted
+	}
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -341,29 +640,33 @@ func (n *Node) AddFile(filePath string) error {
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
 
-	chunker := transfer.NewFileChunker(file, fileInfo.Size())
-	err = chunker.Split()
-	if err != nil {
-		return fmt.Errorf("failed to split file into chunks: %w", err)
-	}
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err = enc.Encode(chunker.Chunks)
+	chunks, tree, err := n.importFile(file, fileInfo.Size())
 	if err != nil {
 		return err
 	}
-
-	hash := crypto.ComputeHash(buf.Bytes())
+	hash := tree.Root()
 
 	n.mu.Lock()
-	defer n.mu.Unlock()
+	previous := n.files[filePath]
 	n.files[filePath] = &FileInfo{
-		Name: fileInfo.Name(),
-		Size: fileInfo.Size(),
-		Hash: hash,
+		Name:   fileInfo.Name(),
+		Size:   fileInfo.Size(),
+		Hash:   hash,
+		Chunks: chunks,
+		Added:  time.Now(),
+		tree:   tree,
+	}
+	n.mu.Unlock()
+
+	if previous != nil {
+		n.releaseChunks(previous.Chunks)
+	}
+	if err := n.saveState(); err != nil {
+		log.Printf("Failed to save state: %v", err)
 	}
 
+	n.spawn(func() { n.announceFile(hash) })
+
 	return nil
 }
 
@@ -387,72 +690,26 @@ func (n *Node) DownloadFile(filePath string) error {
 		return fmt.Errorf("file not found: %s", filePath)
 	}
 
-	knownNodes := n.dht.FindClosestNodes(fileInfo.Hash, 5)
-	if len(knownNodes) == 0 {
-		return fmt.Errorf("no peers found for file: %s", filePath)
-	}
-
-	targetNode := knownNodes[0]
-	conn, err := net.Dial("tcp", targetNode.Address)
+	err := n.Download(n.ctx, fileInfo.Hash, "downloaded_"+fileInfo.Name)
 	if err != nil {
-		return fmt.Errorf("failed to connect to peer: %w", err)
-	}
-	defer conn.Close()
-
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-
-	_, err = rw.WriteString(fmt.Sprintf("GET_FILE %s\n", filePath))
-	if err != nil {
-		return fmt.Errorf("failed to write GET_FILE command: %w", err)
-	}
-	err = rw.Flush()
-	if err != nil {
-		return fmt.Errorf("failed to flush GET_FILE command: %w", err)
-	}
-
-	resp, err := rw.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("failed to read response: %w", err)
-	}
-	resp = strings.TrimSpace(resp)
-
-	if resp != "OK" {
-		return fmt.Errorf("peer responded with error: %s", resp)
-	}
-
-	outputFile, err := os.Create("downloaded_" + fileInfo.Name)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outputFile.Close()
-
-	_, err = io.Copy(outputFile, rw.Reader)
-	if err != nil {
-		return fmt.Errorf("failed to copy file from peer: %w", err)
+		return err
 	}
 
 	log.Printf("File %s downloaded successfully", fileInfo.Name)
 	return nil
 }
 
-func (n *Node) HandleGetFile(conn net.Conn, filePath string) error {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer file.Close()
-
-	_, err = fmt.Fprint(conn, "OK\n")
-	if err != nil {
-		return fmt.Errorf("failed to write OK response: %w", err)
-	}
+func (n *Node) fileByHash(hash []byte) (string, *FileInfo, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 
-	_, err = io.Copy(conn, file)
-	if err != nil {
-		return fmt.Errorf("failed to copy file to connection: %w", err)
+	for filePath, fileInfo := range n.files {
+		if bytes.Equal(fileInfo.Hash, hash) {
+			copied := *fileInfo
+			return filePath, &copied, true
+		}
 	}
-
-	return nil
+	return "", nil, false
 }
 
 func (n *Node) ListPeers() []Peer {
@@ -479,13 +736,17 @@ func (n *Node) ListFiles() []FileInfo {
 
 func (n *Node) RemoveFile(filePath string) error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
+	fileInfo, ok := n.files[filePath]
+	delete(n.files, filePath)
+	n.mu.Unlock()
 
-	if _, ok := n.files[filePath]; !ok {
+	if !ok {
 		return fmt.Errorf("file not found: %s", filePath)
 	}
-
-	delete(n.files, filePath)
+	n.releaseChunks(fileInfo.Chunks)
+	if err := n.saveState(); err != nil {
+		log.Printf("Failed to save state: %v", err)
+	}
 	return nil
 }
 
@@ -599,6 +860,18 @@ func (n *Node) SetEncryptor(encryptor *crypto.Encryptor) {
 	n.encryptor = encryptor
 }
 
+func (n *Node) GetIdentity() *crypto.Identity {
+	return n.identity
+}
+
+// SessionCount returns the number of open outbound peer sessions.
+func (n *Node) SessionCount() int {
+	if n.pool == nil {
+		return 0
+	}
+	return n.pool.len()
+}
+
 func (n *Node) GetPrivateKey() *rsa.PrivateKey {
 	return n.privateKey
 }
@@ -632,11 +905,15 @@ func (n *Node) ClearFiles() {
 }
 
 func (n *Node) IsPeerConnected(address string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	_, ok := n.peers[address]
 	return ok
 }
 
 func (n *Node) IsFileShared(fileName string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	_, ok := n.files[fileName]
 	return ok
 }
@@ -1223,6 +1500,6 @@ func (n *Node) cleanup() {
 
 	// Clear DHT nodes
 	if n.dht != nil {
-		n.dht.Nodes = make(map[string]*dht.Node)
+		n.dht.Clear()
 	}
 }
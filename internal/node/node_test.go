@@ -1,8 +1,25 @@
 package node_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"meshfile/internal/dht"
 	"meshfile/internal/node"
+	"meshfile/internal/transfer"
+	"meshfile/internal/wire"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -29,17 +46,67 @@ func cleanupTestFile(t *testing.T) {
 
 // Test helper function to setup a node
 func setupNode(t *testing.T) *node.Node {
-	config := &node.Config{Port: 0, WebUIPort: 0} // Use dynamic ports
+	config := &node.Config{Port: 0} // Use dynamic ports
 	n := node.NewNode(config)
-	err := n.Start()
+	err := n.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start node: %v", err)
 	}
 	return n
 }
 
+// Test helper function to reserve a free TCP port
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// Test helper function to setup a node reachable by other nodes
+func setupListeningNode(t *testing.T, bootstrapPeers ...string) (*node.Node, *dht.Node) {
+	return setupListeningNodeWithConfig(t, &node.Config{BootstrapPeers: bootstrapPeers})
+}
+
+// Test helper function to setup a listening node on a port chosen by the
+// kernel. Unless the config says otherwise it binds to and advertises
+// localhost.
+func setupListeningNodeWithConfig(t *testing.T, config *node.Config) (*node.Node, *dht.Node) {
+	if config.ListenAddr == "" {
+		config.ListenAddr = "localhost:0"
+	}
+	n := node.NewNode(config)
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	contact := &dht.Node{
+		ID:       n.GetDHT().LocalID,
+		Address:  fmt.Sprintf("localhost:%d", listenPort(n)),
+		LastSeen: time.Now(),
+	}
+	return n, contact
+}
+
+func listenPort(n *node.Node) int {
+	return n.ListenAddr().(*net.TCPAddr).Port
+}
+
+// Test helper function to wait for a condition to become true
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
 func TestNewNode(t *testing.T) {
-	config := &node.Config{Port: 8080, WebUIPort: 8081}
+	config := &node.Config{Port: 8080}
 	n := node.NewNode(config)
 	if n == nil {
 		t.Fatal("Expected new node to be created")
@@ -56,6 +123,95 @@ func TestNodeStartStop(t *testing.T) {
 	defer n.Stop()
 }
 
+func TestNodeReportsBoundPorts(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	for name, addr := range map[string]net.Addr{"DHT": n.ListenAddr(), "file server": n.FileServerAddr()} {
+		tcpAddr, ok := addr.(*net.TCPAddr)
+		if !ok || tcpAddr.Port == 0 {
+			t.Fatalf("Expected %s to report its bound port, got %v", name, addr)
+		}
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", tcpAddr.Port))
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %v", name, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestNodeStartReportsListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to reserve port: %v", err)
+	}
+	defer ln.Close()
+
+	n := node.NewNode(&node.Config{Port: ln.Addr().(*net.TCPAddr).Port})
+	if err := n.Start(context.Background()); err == nil {
+		n.Stop()
+		t.Fatal("Expected Start to fail on a port that is in use")
+	}
+}
+
+func TestNodeStopsWhenContextIsCancelled(t *testing.T) {
+	a, contactA := setupListeningNode(t)
+	b, _ := setupListeningNode(t, contactA.Address)
+	defer b.Stop()
+	waitFor(t, 5*time.Second, func() bool { return b.IsPeerConnected(contactA.Address) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := node.NewNode(&node.Config{BootstrapPeers: []string{contactA.Address}})
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	port := listenPort(c)
+	cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		c.Stop()
+		a.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Stop did not return after the context was cancelled")
+	}
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("Listener was not closed on stop: %v", err)
+	}
+	ln.Close()
+}
+
+func TestNodeRequiresStart(t *testing.T) {
+	n := node.NewNode(&node.Config{})
+	ctx := context.Background()
+	key := make([]byte, sha256.Size)
+
+	if err := n.Download(ctx, key, filepath.Join(t.TempDir(), "out")); err == nil {
+		t.Error("Expected Download to fail before Start")
+	}
+	if _, err := n.Lookup(ctx, key); err == nil {
+		t.Error("Expected Lookup to fail before Start")
+	}
+	if _, err := n.FindProviders(ctx, key); err == nil {
+		t.Error("Expected FindProviders to fail before Start")
+	}
+	if err := n.Provide(ctx, key); err == nil {
+		t.Error("Expected Provide to fail before Start")
+	}
+
+	n = setupNode(t)
+	n.Stop()
+	if err := n.Download(ctx, key, filepath.Join(t.TempDir(), "out")); err == nil {
+		t.Error("Expected Download to fail after Stop")
+	}
+}
+
 func TestNodeAddFile(t *testing.T) {
 
 	n := setupNode(t)
@@ -75,6 +231,37 @@ func TestNodeAddFile(t *testing.T) {
 	}
 }
 
+func TestNodeAddFileAfterStop(t *testing.T) {
+	n := setupNode(t)
+	n.Stop()
+
+	srcPath := filepath.Join(t.TempDir(), "late.txt")
+	if err := os.WriteFile(srcPath, []byte(TEST_DATA), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := n.AddFile(srcPath); err == nil {
+		t.Error("Expected AddFile to fail after Stop")
+	}
+}
+
+func TestNodeFileHashIsMerkleRoot(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	createTestFile(t)
+	defer cleanupTestFile(t)
+
+	if err := n.AddFile(TEST_FILE); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+
+	chunkHash := sha256.Sum256([]byte(TEST_DATA))
+	expected := transfer.MerkleRoot([][]byte{chunkHash[:]})
+	if !bytes.Equal(n.GetFileHash(TEST_FILE), expected) {
+		t.Errorf("Expected file hash %x, got %x", expected, n.GetFileHash(TEST_FILE))
+	}
+}
+
 func TestNodeEncryptDecryptData(t *testing.T) {
 	n := setupNode(t)
 	defer n.Stop()
@@ -173,3 +360,917 @@ func TestNodeGetFileCount(t *testing.T) {
 		t.Fatalf("Expected 1 file, got %d", count)
 	}
 }
+
+func TestNodeLookup(t *testing.T) {
+	nodes := make([]*node.Node, 4)
+	contacts := make([]*dht.Node, 4)
+	for i := range nodes {
+		nodes[i], contacts[i] = setupListeningNode(t)
+		defer nodes[i].Stop()
+	}
+
+	// Each node only knows the next one in the chain.
+	for i := 0; i < len(nodes)-1; i++ {
+		nodes[i].GetDHT().AddNode(contacts[i+1])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	target := contacts[3].ID
+	found, err := nodes[0].Lookup(ctx, target)
+	if err != nil {
+		t.Fatalf("Lookup failed: %v", err)
+	}
+	if len(found) == 0 || string(found[0].ID) != string(target) {
+		t.Fatalf("Expected lookup to find the last node in the chain, got %v", found)
+	}
+	if _, ok := nodes[0].GetDHT().GetNode(target); !ok {
+		t.Errorf("Expected responding node to be added to the routing table")
+	}
+}
+
+func TestNodeLookupWithoutContacts(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	if _, err := n.Lookup(context.Background(), n.GetDHT().LocalID); err == nil {
+		t.Fatal("Expected lookup with an empty routing table to fail")
+	}
+}
+
+func TestNodeBootstrap(t *testing.T) {
+	seed, seedContact := setupListeningNode(t)
+	defer seed.Stop()
+	other, otherContact := setupListeningNode(t, seedContact.Address)
+	defer other.Stop()
+	waitFor(t, 5*time.Second, func() bool {
+		_, ok := seed.GetDHT().GetNode(otherContact.ID)
+		return ok
+	})
+
+	joining, joiningContact := setupListeningNode(t, seedContact.Address)
+	defer joining.Stop()
+
+	waitFor(t, 5*time.Second, func() bool {
+		_, ok := joining.GetDHT().GetNode(otherContact.ID)
+		return ok
+	})
+	if _, ok := seed.GetDHT().GetNode(joiningContact.ID); !ok {
+		t.Errorf("Expected bootstrap peer to learn about the joining node")
+	}
+	if !joining.IsPeerConnected(seedContact.Address) {
+		t.Errorf("Expected bootstrap peer to be recorded as a peer")
+	}
+}
+
+func TestNodeProvideAndFindProviders(t *testing.T) {
+	nodes := make([]*node.Node, 3)
+	contacts := make([]*dht.Node, 3)
+	for i := range nodes {
+		nodes[i], contacts[i] = setupListeningNode(t)
+		defer nodes[i].Stop()
+	}
+
+	for i := 0; i < len(nodes)-1; i++ {
+		nodes[i].GetDHT().AddNode(contacts[i+1])
+		nodes[i+1].GetDHT().AddNode(contacts[i])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := nodes[0].Provide(ctx, key); err != nil {
+		t.Fatalf("Provide failed: %v", err)
+	}
+
+	providers, err := nodes[2].FindProviders(ctx, key)
+	if err != nil {
+		t.Fatalf("FindProviders failed: %v", err)
+	}
+	if len(providers) != 1 || string(providers[0].NodeID) != string(contacts[0].ID) {
+		t.Fatalf("Expected the first node as the only provider, got %v", providers)
+	}
+	if providers[0].Address != contacts[0].Address {
+		t.Errorf("Expected provider address %s, got %s", contacts[0].Address, providers[0].Address)
+	}
+}
+
+// Test helper function to overwrite a block in a node's block store
+func writeBlock(t *testing.T, n *node.Node, hash, data []byte) {
+	key := hex.EncodeToString(hash)
+	path := filepath.Join(n.BlockStore().Dir(), "blocks", key[:2], key)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write block: %v", err)
+	}
+}
+
+// Test helper function to connect two nodes in both directions
+func connectNodes(a, b *node.Node, contactA, contactB *dht.Node) {
+	a.GetDHT().AddNode(contactB)
+	b.GetDHT().AddNode(contactA)
+}
+
+// Test helper function to share content from one node and wait until a
+// second, connected node can find it. It returns both nodes, the file's hash
+// and its source path.
+func setupSharedFile(t *testing.T, sharerConfig *node.Config, content []byte) (sharer, fetcher *node.Node, hash []byte, srcPath string) {
+	t.Helper()
+	sharer, sharerContact := setupListeningNodeWithConfig(t, sharerConfig)
+	t.Cleanup(sharer.Stop)
+	fetcher, fetcherContact := setupListeningNode(t)
+	t.Cleanup(fetcher.Stop)
+	connectNodes(sharer, fetcher, sharerContact, fetcherContact)
+
+	srcPath = filepath.Join(t.TempDir(), "shared.bin")
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := sharer.AddFile(srcPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	hash = sharer.GetFileHash(srcPath)
+	waitFor(t, 5*time.Second, func() bool {
+		return len(fetcher.GetDHT().GetProviders(hash)) > 0
+	})
+	return sharer, fetcher, hash, srcPath
+}
+
+func TestNodeDownloadByHash(t *testing.T) {
+	content := []byte("content served by hash, not by path")
+	_, fetcher, hash, _ := setupSharedFile(t, &node.Config{}, content)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	destPath := dir + "/downloaded.txt"
+	if err := fetcher.Download(ctx, hash, destPath); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatalf("Downloaded content mismatch: %q", got)
+	}
+
+	unknown := make([]byte, len(hash))
+	provider := fetcher.GetDHT().GetProviders(hash)[0]
+	fetcher.GetDHT().AddProvider(&dht.ProviderRecord{Key: unknown, NodeID: provider.NodeID, Address: provider.Address})
+	if err := fetcher.Download(ctx, unknown, dir+"/missing.txt"); err == nil {
+		t.Fatal("Expected download of an unshared hash to fail")
+	}
+	if _, err := os.Stat(dir + "/missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected no output file for a failed download")
+	}
+}
+
+func TestNodeHandleGetFile(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	content := make([]byte, 2*transfer.ChunkSize+100)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	srcPath := t.TempDir() + "/whole.bin"
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := n.AddFile(srcPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	hash := n.GetFileHash(srcPath)
+
+	var buf bytes.Buffer
+	if err := n.HandleGetFile(&buf, 7, hash); err != nil {
+		t.Fatalf("HandleGetFile failed: %v", err)
+	}
+	header, err := wire.ReadFrame(&buf)
+	if err != nil || header.Type != wire.TypeFile || header.RequestID != 7 {
+		t.Fatalf("Expected FILE header for request 7, got %v (%v)", header, err)
+	}
+	d := wire.NewDecoder(header.Payload)
+	if size, got := d.Uint(), d.Bytes(); d.Err() != nil || size != uint64(len(content)) || !bytes.Equal(got, hash) {
+		t.Fatalf("Unexpected FILE header: size %d, hash %x", size, got)
+	}
+
+	var body []byte
+	var chunkHashes [][]byte
+	for buf.Len() > 0 {
+		frame, err := wire.ReadFrame(&buf)
+		if err != nil || frame.Type != wire.TypeData || frame.RequestID != 7 {
+			t.Fatalf("Expected DATA for request 7, got %v (%v)", frame, err)
+		}
+		d := wire.NewDecoder(frame.Payload)
+		chunkHash, proofs, data := d.Bytes(), d.Count(1), d.Bytes()
+		if d.Err() != nil || proofs != 0 {
+			t.Fatalf("Malformed DATA frame")
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], chunkHash) {
+			t.Fatalf("Chunk data does not match its hash")
+		}
+		body = append(body, data...)
+		chunkHashes = append(chunkHashes, chunkHash)
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatal("GET_FILE body does not match the shared file")
+	}
+	if len(chunkHashes) != 3 || !bytes.Equal(transfer.MerkleRoot(chunkHashes), hash) {
+		t.Fatalf("Expected 3 chunks adding up to the file hash, got %d", len(chunkHashes))
+	}
+
+	buf.Reset()
+	if err := n.HandleGetFile(&buf, 8, make([]byte, len(hash))); err != nil {
+		t.Fatalf("HandleGetFile failed: %v", err)
+	}
+	if frame, err := wire.ReadFrame(&buf); err != nil || frame.Type != wire.TypeError || frame.RequestID != 8 {
+		t.Fatalf("Expected ERROR for an unknown file, got %v (%v)", frame, err)
+	}
+}
+
+func TestNodeServesStoredCopyAfterSourceChanges(t *testing.T) {
+	content := []byte("content kept in the block store")
+	sharer, fetcher, hash, srcPath := setupSharedFile(t, &node.Config{}, content)
+	if err := os.Remove(srcPath); err != nil {
+		t.Fatalf("Failed to remove source file: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	destPath := filepath.Join(t.TempDir(), "downloaded.txt")
+	if err := fetcher.Download(ctx, hash, destPath); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if got, _ := os.ReadFile(destPath); !bytes.Equal(got, content) {
+		t.Fatalf("Downloaded content mismatch: %q", got)
+	}
+
+	if err := sharer.RemoveFile(srcPath); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	if blocks := sharer.BlockStore().Len(); blocks != 0 {
+		t.Errorf("Expected unshared blocks to be collected, %d left", blocks)
+	}
+}
+
+func TestNodeOpenFileStreamsFromProviders(t *testing.T) {
+	content := make([]byte, 5*1024*1024/2)
+	for i := range content {
+		content[i] = byte(i * 17)
+	}
+	sharer, fetcher, hash, _ := setupSharedFile(t, &node.Config{}, content)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for name, n := range map[string]*node.Node{"local": sharer, "remote": fetcher} {
+		file, err := n.OpenFile(ctx, hash)
+		if err != nil {
+			t.Fatalf("Failed to open %s file: %v", name, err)
+		}
+		got, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("Failed to read %s file: %v", name, err)
+		}
+		if file.Size != int64(len(content)) || !bytes.Equal(got, content) {
+			t.Errorf("Read %d bytes of %s file, expected %d", len(got), name, len(content))
+		}
+		if file.Local() != (n == sharer) {
+			t.Errorf("Expected %s file to report Local() = %v", name, n == sharer)
+		}
+		if file.Added.IsZero() != (n == fetcher) {
+			t.Errorf("Expected only the local file to carry its share time, got %v for %s", file.Added, name)
+		}
+	}
+
+	if _, err := fetcher.OpenFile(ctx, make([]byte, len(hash))); err == nil {
+		t.Error("Expected opening an unknown hash to fail")
+	}
+	if _, err := node.NewNode(&node.Config{}).OpenFile(ctx, hash); err == nil {
+		t.Error("Expected OpenFile to fail before the node is started")
+	}
+}
+
+func TestNodeSwarmDownloadRetriesBadChunks(t *testing.T) {
+	fetcher, fetcherContact := setupListeningNode(t)
+	defer fetcher.Stop()
+	good, goodContact := setupListeningNode(t)
+	defer good.Stop()
+	bad, badContact := setupListeningNode(t)
+	defer bad.Stop()
+	connectNodes(fetcher, good, fetcherContact, goodContact)
+	connectNodes(fetcher, bad, fetcherContact, badContact)
+
+	content := make([]byte, 5*1024*1024/2)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	dir := t.TempDir()
+	goodPath := dir + "/good.bin"
+	badPath := dir + "/bad.bin"
+	for _, path := range []string{goodPath, badPath} {
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+	if err := good.AddFile(goodPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	if err := bad.AddFile(badPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	hash := good.GetFileHash(goodPath)
+
+	// Corrupt the second provider's stored copy after it has been indexed.
+	for _, chunk := range bad.GetFiles()[0].Chunks {
+		writeBlock(t, bad, chunk.Hash, make([]byte, chunk.Size))
+	}
+
+	waitFor(t, 5*time.Second, func() bool {
+		return len(fetcher.GetDHT().GetProviders(hash)) == 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	destPath := dir + "/downloaded.bin"
+	if err := fetcher.Download(ctx, hash, destPath); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("Downloaded content does not match the original")
+	}
+}
+
+func TestNodeDownloadResumes(t *testing.T) {
+	const chunkSize = 1024 * 1024
+	content := make([]byte, 2*chunkSize+100)
+	for i := range content {
+		content[i] = byte(i * 13)
+	}
+	sharer, fetcher, hash, _ := setupSharedFile(t, &node.Config{}, content)
+	dir := t.TempDir()
+
+	chunks := sharer.GetFiles()[0].Chunks
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d", len(chunks))
+	}
+	corruptChunks := func(broken ...int) {
+		for i, chunk := range chunks {
+			data := append([]byte(nil), content[chunk.Offset:chunk.Offset+chunk.Size]...)
+			for _, b := range broken {
+				if b == i {
+					data[0] ^= 0xff
+				}
+			}
+			writeBlock(t, sharer, chunk.Hash, data)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	destPath := dir + "/downloaded.bin"
+
+	// Only the last chunk is broken, so the first attempt stops part way.
+	corruptChunks(2)
+	if err := fetcher.Download(ctx, hash, destPath); err == nil {
+		t.Fatal("Expected download to fail while the last chunk is corrupt")
+	}
+	if _, err := os.Stat(destPath + ".part"); err != nil {
+		t.Fatalf("Expected partial file to be kept: %v", err)
+	}
+
+	// Now only the first chunks are broken; finishing requires a resume.
+	corruptChunks(0, 1)
+	if err := fetcher.Download(ctx, hash, destPath); err != nil {
+		t.Fatalf("Resumed download failed: %v", err)
+	}
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Fatal("Downloaded content does not match the original")
+	}
+	if _, err := os.Stat(destPath + ".part.json"); !os.IsNotExist(err) {
+		t.Errorf("Expected download state to be removed after completion")
+	}
+	if _, err := os.Stat(destPath + ".part.json.log"); !os.IsNotExist(err) {
+		t.Errorf("Expected download log to be removed after completion")
+	}
+}
+
+func TestNodeDownloadContentDefinedChunks(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	for i := range content {
+		content[i] = byte(i*31 + i/4096)
+	}
+	_, fetcher, hash, _ := setupSharedFile(t, &node.Config{Chunker: transfer.DefaultFastCDC()}, content)
+	dir := t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The fetcher uses fixed-size chunks itself but follows the manifest.
+	destPath := dir + "/downloaded.bin"
+	if err := fetcher.Download(ctx, hash, destPath); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	got, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("Downloaded content does not match the original")
+	}
+}
+
+func TestNodeIdentityPersistsAcrossRestarts(t *testing.T) {
+	identityPath := t.TempDir() + "/identity.pem"
+
+	first := node.NewNode(&node.Config{IdentityPath: identityPath})
+	if err := first.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	firstID := first.GetDHT().LocalID
+	first.Stop()
+
+	second := node.NewNode(&node.Config{IdentityPath: identityPath})
+	if err := second.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	defer second.Stop()
+
+	if !bytes.Equal(firstID, second.GetDHT().LocalID) {
+		t.Errorf("Expected the same DHT ID after restart")
+	}
+	expected := dht.IDFromPublicKey(second.GetIdentity().PublicKey())
+	if !bytes.Equal(second.GetDHT().LocalID, expected) {
+		t.Errorf("Expected DHT ID to be derived from the identity key")
+	}
+}
+
+func TestNodeRestoresStateFromDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	peer, peerContact := setupListeningNode(t)
+	defer peer.Stop()
+
+	first, _ := setupListeningNodeWithConfig(t, &node.Config{DataDir: dataDir})
+	first.GetDHT().AddNode(peerContact)
+	first.AddPeer(peerContact.Address)
+
+	srcPath := filepath.Join(t.TempDir(), "shared.txt")
+	if err := os.WriteFile(srcPath, []byte(TEST_DATA), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := first.AddFile(srcPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	hash := first.GetFileHash(srcPath)
+	firstID := first.GetDHT().LocalID
+	first.Stop()
+	if err := os.Remove(srcPath); err != nil {
+		t.Fatalf("Failed to remove source file: %v", err)
+	}
+
+	second, _ := setupListeningNodeWithConfig(t, &node.Config{DataDir: dataDir})
+	defer second.Stop()
+
+	if !bytes.Equal(second.GetDHT().LocalID, firstID) {
+		t.Errorf("Expected the identity to be kept in the data directory")
+	}
+	if !bytes.Equal(second.GetFileHash(srcPath), hash) {
+		t.Errorf("Expected shared file %s to be restored", srcPath)
+	}
+	if _, ok := second.GetDHT().GetNode(peerContact.ID); !ok {
+		t.Errorf("Expected routing table to be restored")
+	}
+	if !second.IsPeerConnected(peerContact.Address) {
+		t.Errorf("Expected peer table to be restored")
+	}
+	if refs := second.BlockStore().Refs(second.GetFiles()[0].Chunks[0].Hash); refs != 1 {
+		t.Errorf("Expected restored file to reference its block once, got %d", refs)
+	}
+}
+
+// Test helper function to send a raw HTTP request, so the client does not
+// clean or re-encode the path
+func rawGet(t *testing.T, addr net.Addr, path string) (int, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", addr.(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Failed to connect to file server: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n", path)
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read response for %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestNodeDropsFilesWithCorruptBlocksOnRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	first, _ := setupListeningNodeWithConfig(t, &node.Config{DataDir: dataDir})
+
+	dir := t.TempDir()
+	for name, data := range map[string]string{"kept.txt": "kept data", "corrupt.txt": "corrupt data"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		if err := first.AddFile(filepath.Join(dir, name)); err != nil {
+			t.Fatalf(FILE_ADD_ERROR, err)
+		}
+	}
+	first.Stop()
+
+	sum := sha256.Sum256([]byte("corrupt data"))
+	key := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(dataDir, "blocks", key[:2], key), []byte("flipped bits"), 0600); err != nil {
+		t.Fatalf("Failed to corrupt block: %v", err)
+	}
+
+	second, _ := setupListeningNodeWithConfig(t, &node.Config{DataDir: dataDir})
+	defer second.Stop()
+	if !second.IsFileShared(filepath.Join(dir, "kept.txt")) {
+		t.Error("Expected the intact file to be restored")
+	}
+	if second.IsFileShared(filepath.Join(dir, "corrupt.txt")) {
+		t.Error("Expected the file with a corrupt block to be dropped")
+	}
+	if blocks := second.BlockStore().Len(); blocks != 1 {
+		t.Errorf("Expected only the intact block to remain, got %d", blocks)
+	}
+}
+
+func TestNodeStartFailsOnUnreadableState(t *testing.T) {
+	dataDir := t.TempDir()
+	statePath := filepath.Join(dataDir, "state.json")
+	corrupt := []byte("{not json")
+	if err := os.WriteFile(statePath, corrupt, 0600); err != nil {
+		t.Fatalf("Failed to write state file: %v", err)
+	}
+
+	n := node.NewNode(&node.Config{ListenAddr: "localhost:0", DataDir: dataDir})
+	if err := n.Start(context.Background()); err == nil {
+		t.Fatal("Expected Start to fail on an unparseable state file")
+	}
+	n.Stop()
+
+	if got, err := os.ReadFile(statePath); err != nil || !bytes.Equal(got, corrupt) {
+		t.Errorf("Expected the state file to be left untouched, got %q (%v)", got, err)
+	}
+	srcPath := filepath.Join(t.TempDir(), "shared.txt")
+	if err := os.WriteFile(srcPath, []byte(TEST_DATA), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := n.AddFile(srcPath); err == nil {
+		t.Error("Expected AddFile to fail after Start failed")
+	}
+}
+
+func TestNodeFileServerServesSharedContentByHash(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	srcPath := filepath.Join(t.TempDir(), "shared.txt")
+	if err := os.WriteFile(srcPath, []byte(TEST_DATA), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := n.AddFile(srcPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	id := hex.EncodeToString(n.GetFileHash(srcPath))
+
+	if status, body := rawGet(t, n.FileServerAddr(), "/files/"+id); status != http.StatusOK || body != TEST_DATA {
+		t.Errorf("Expected shared file, got %d %q", status, body)
+	}
+	unknown := strings.Repeat("ab", len(id)/2)
+	if status, _ := rawGet(t, n.FileServerAddr(), "/files/"+unknown); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unshared hash, got %d", status)
+	}
+}
+
+func TestNodeFileServerRejectsPaths(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	dir := t.TempDir()
+	secret := "not for peers"
+	secretPath := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(secretPath, []byte(secret), 0644); err != nil {
+		t.Fatalf("Failed to create secret file: %v", err)
+	}
+	// Sharing a file must not make its path servable either.
+	sharedPath := filepath.Join(dir, "shared.txt")
+	if err := os.WriteFile(sharedPath, []byte(secret), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := n.AddFile(sharedPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	id := hex.EncodeToString(n.GetFileHash(sharedPath))
+
+	wd, _ := os.Getwd()
+	relative, err := filepath.Rel(wd, secretPath)
+	if err != nil {
+		t.Fatalf("Failed to build relative path: %v", err)
+	}
+	attacks := []string{
+		"/files/" + url.PathEscape(secretPath),
+		"/files/" + url.QueryEscape(secretPath),
+		"/files" + secretPath,
+		"/files/" + relative,
+		"/files/" + url.PathEscape(relative),
+		"/files/..%2F..%2F..%2F..%2F..%2F..%2F..%2F..%2Fetc%2Fpasswd",
+		"/files/../../../../../../etc/passwd",
+		"/files/" + url.PathEscape(sharedPath),
+		"/files/" + id + "/../" + url.PathEscape(secretPath),
+		"/files/" + id + "%2F..%2Fsecret.txt",
+		"/files/",
+	}
+	for _, path := range attacks {
+		status, body := rawGet(t, n.FileServerAddr(), path)
+		if status == http.StatusOK || strings.Contains(body, secret) || strings.Contains(body, "root:") {
+			t.Errorf("Request for %s was served: %d %q", path, status, body)
+		}
+	}
+}
+
+// Test helper function to request a shared file with extra headers
+func fileGet(t *testing.T, n *node.Node, id string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	port := n.FileServerAddr().(*net.TCPAddr).Port
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/files/%s", port, id), nil)
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return resp, body
+}
+
+func TestNodeFileServerRangeAndConditionalRequests(t *testing.T) {
+	n := setupNode(t)
+	defer n.Stop()
+
+	// Several chunks, so ranges have to cross chunk boundaries.
+	content := make([]byte, 5*1024*1024/2)
+	for i := range content {
+		content[i] = byte(i * 11)
+	}
+	srcPath := filepath.Join(t.TempDir(), "media.bin")
+	if err := os.WriteFile(srcPath, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := n.AddFile(srcPath); err != nil {
+		t.Fatalf(FILE_ADD_ERROR, err)
+	}
+	id := hex.EncodeToString(n.GetFileHash(srcPath))
+
+	resp, body := fileGet(t, n, id, nil)
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, content) {
+		t.Fatalf("Expected the whole file, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if etag != `"`+id+`"` || resp.Header.Get("Last-Modified") == "" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Missing validators: ETag %q, Last-Modified %q", etag, resp.Header.Get("Last-Modified"))
+	}
+
+	const start, end = 1024*1024 - 10, 1024*1024 + 9
+	resp, body = fileGet(t, n, id, map[string]string{"Range": fmt.Sprintf("bytes=%d-%d", start, end)})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[start:end+1]) {
+		t.Errorf("Expected bytes %d-%d, got %d with %d bytes", start, end, resp.StatusCode, len(body))
+	}
+
+	resp, body = fileGet(t, n, id, map[string]string{"Range": "bytes=-100"})
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, content[len(content)-100:]) {
+		t.Errorf("Expected the last 100 bytes, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+
+	resp, body = fileGet(t, n, id, map[string]string{"Range": "bytes=0-9,2097152-2097161"})
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusPartialContent || mediaType != "multipart/byteranges" {
+		t.Fatalf("Expected multipart byteranges, got %d %s", resp.StatusCode, mediaType)
+	}
+	parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for _, want := range [][]byte{content[0:10], content[2097152:2097162]} {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("Failed to read part: %v", err)
+		}
+		if got, _ := io.ReadAll(part); !bytes.Equal(got, want) {
+			t.Errorf("Unexpected part %s", part.Header.Get("Content-Range"))
+		}
+	}
+
+	if resp, _ := fileGet(t, n, id, map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag, got %d", resp.StatusCode)
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp, _ := fileGet(t, n, id, map[string]string{"If-Modified-Since": lastModified}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for If-Modified-Since, got %d", resp.StatusCode)
+	}
+
+	resp, body = fileGet(t, n, id, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	if resp.StatusCode != http.StatusPartialContent || len(body) != 10 {
+		t.Errorf("Expected If-Range with the current ETag to honour the range, got %d", resp.StatusCode)
+	}
+	resp, body = fileGet(t, n, id, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	if resp.StatusCode != http.StatusOK || len(body) != len(content) {
+		t.Errorf("Expected If-Range with a stale ETag to send the whole file, got %d", resp.StatusCode)
+	}
+
+	if resp, _ := fileGet(t, n, id, map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(content))}); resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 for a range past the end, got %d", resp.StatusCode)
+	}
+}
+
+func TestNodeRejectsPlaintextPeers(t *testing.T) {
+	n, contact := setupListeningNode(t)
+	defer n.Stop()
+
+	conn, err := net.DialTimeout("tcp", contact.Address, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	fmt.Fprintf(conn, "PING\n{}\n")
+	buf := make([]byte, 64)
+	if m, _ := conn.Read(buf); bytes.Contains(buf[:m], []byte("PONG")) {
+		t.Fatal("Node answered a plaintext PING")
+	}
+}
+
+func TestNodeLookupRejectsMismatchedIdentity(t *testing.T) {
+	a, _ := setupListeningNode(t)
+	defer a.Stop()
+	b, contactB := setupListeningNode(t)
+	defer b.Stop()
+
+	// Claim b's address under a different ID.
+	impostor := &dht.Node{ID: bytes.Repeat([]byte{0xAB}, dht.IDLength), Address: contactB.Address}
+	a.GetDHT().AddNode(impostor)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	nodes, _ := a.Lookup(ctx, contactB.ID)
+
+	if len(nodes) != 0 {
+		t.Errorf("Expected no responders, got %d", len(nodes))
+	}
+	if _, ok := a.GetDHT().GetNode(contactB.ID); ok {
+		t.Error("Peer was accepted under an identity it did not prove")
+	}
+}
+
+func TestNodeReusesPeerSessions(t *testing.T) {
+	a, contactA := setupListeningNode(t)
+	defer a.Stop()
+	b, contactB := setupListeningNode(t)
+	defer b.Stop()
+	connectNodes(a, b, contactA, contactB)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		if _, err := a.Lookup(ctx, contactB.ID); err != nil {
+			t.Fatalf("Lookup failed: %v", err)
+		}
+	}
+
+	if count := a.SessionCount(); count != 1 {
+		t.Errorf("Expected lookups to share 1 session, got %d", count)
+	}
+}
+
+func TestNodeHealthCheckEvictsDeadPeers(t *testing.T) {
+	a, _ := setupListeningNodeWithConfig(t, &node.Config{HealthInterval: 50 * time.Millisecond})
+	defer a.Stop()
+	b, contactB := setupListeningNode(t)
+	defer b.Stop()
+
+	events, unsubscribe := a.SubscribePeerEvents()
+	defer unsubscribe()
+
+	// Nothing listens on the dead peer's port.
+	dead := &dht.Node{ID: bytes.Repeat([]byte{0xCD}, dht.IDLength), Address: fmt.Sprintf("localhost:%d", freePort(t))}
+	a.GetDHT().AddNode(dead)
+	a.AddPeer(dead.Address)
+	a.AddPeer(contactB.Address)
+
+	var transitions []node.PeerState
+	timeout := time.After(5 * time.Second)
+	for len(transitions) < 2 {
+		select {
+		case ev := <-events:
+			if ev.Address != dead.Address {
+				t.Fatalf("Unexpected event for %s: %s -> %s", ev.Address, ev.From, ev.To)
+			}
+			transitions = append(transitions, ev.To)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for peer events, got %v", transitions)
+		}
+	}
+	if transitions[0] != node.PeerSuspect || transitions[1] != node.PeerDead {
+		t.Errorf("Expected suspect then dead, got %v", transitions)
+	}
+
+	if a.IsPeerConnected(dead.Address) {
+		t.Error("Dead peer was not removed from the peer list")
+	}
+	if _, ok := a.GetDHT().GetNode(dead.ID); ok {
+		t.Error("Dead peer was not removed from the DHT")
+	}
+
+	peer, ok := a.GetPeerByAddress(contactB.Address)
+	if !ok || peer.State != node.PeerAlive || peer.RTT <= 0 || !bytes.Equal(peer.ID, contactB.ID) {
+		t.Errorf("Expected live peer with RTT and ID, got %+v", peer)
+	}
+}
+
+func TestNodeLANDiscovery(t *testing.T) {
+	group := fmt.Sprintf("239.255.77.77:%d", freePort(t))
+	config := func() *node.Config {
+		return &node.Config{ListenAddr: ":0", LANDiscovery: true, LANGroup: group, LANInterface: "lo"}
+	}
+	if _, err := net.InterfaceByName("lo"); err != nil {
+		t.Skip("No loopback interface named lo")
+	}
+
+	a, contactA := setupListeningNodeWithConfig(t, config())
+	defer a.Stop()
+	b, contactB := setupListeningNodeWithConfig(t, config())
+	defer b.Stop()
+
+	waitFor(t, 5*time.Second, func() bool {
+		_, aKnowsB := a.GetDHT().GetNode(contactB.ID)
+		_, bKnowsA := b.GetDHT().GetNode(contactA.ID)
+		return aKnowsB && bKnowsA
+	})
+	found := false
+	for _, peer := range a.ListPeers() {
+		found = found || bytes.Equal(peer.ID, contactB.ID)
+	}
+	if !found {
+		t.Error("Discovered node was not added as a peer")
+	}
+}
+
+func TestNodeIgnoresLoopbackObservedAddress(t *testing.T) {
+	// Leave the advertised address unset so it is derived.
+	start := func(config *node.Config) (*node.Node, int) {
+		n := node.NewNode(config)
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start node: %v", err)
+		}
+		return n, listenPort(n)
+	}
+	a, portA := start(&node.Config{HealthInterval: 50 * time.Millisecond})
+	defer a.Stop()
+	b, portB := start(&node.Config{})
+	defer b.Stop()
+
+	// b sees a's pings come from 127.0.0.1, which tells a nothing about how
+	// other hosts reach it. a still advertises its bound port.
+	a.AddPeer(fmt.Sprintf("127.0.0.1:%d", portB))
+	waitFor(t, 5*time.Second, func() bool {
+		if _, ok := a.GetDHT().GetNode(b.GetDHT().LocalID); !ok {
+			return false // a has not had b's PONG yet
+		}
+		contact, ok := b.GetDHT().GetNode(a.GetDHT().LocalID)
+		if !ok {
+			return false
+		}
+		_, port, err := net.SplitHostPort(contact.Address)
+		return err == nil && port == fmt.Sprint(portA)
+	})
+
+	if observed := a.ObservedAddrs(); len(observed) != 0 {
+		t.Errorf("Expected loopback observations to be ignored, got %v", observed)
+	}
+}
@@ -0,0 +1,262 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"meshfile/internal/dht"
+	"meshfile/internal/mux"
+	"meshfile/internal/wire"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	maxSessions          = 64  // outbound peer sessions kept open
+	maxInboundSessions   = 256 // sessions accepted from other peers
+	maxStreamsPerSession = 64
+	sessionIdleTimeout   = time.Minute
+)
+
+// peerSession is a long-lived multiplexed connection to one peer. Every
+// RPC and chunk transfer to that peer runs on its own stream.
+type peerSession struct {
+	*mux.Session
+	address  string
+	remoteID []byte
+	hello    *wire.Hello
+	lastUsed time.Time
+}
+
+type pendingDial struct {
+	done chan struct{}
+	ps   *peerSession
+	err  error
+}
+
+// sessionPool keeps one outbound session per peer address and shares it
+// between concurrent callers. Concurrent requests for a peer that is not
+// connected yet wait for a single dial.
+type sessionPool struct {
+	dial func(ctx context.Context, peer *dht.Node) (*peerSession, error)
+
+	mu       sync.Mutex
+	sessions map[string]*peerSession
+	dialing  map[string]*pendingDial
+	closed   bool
+}
+
+var errPoolClosed = errors.New("node is shutting down")
+
+func newSessionPool(dial func(ctx context.Context, peer *dht.Node) (*peerSession, error)) *sessionPool {
+	return &sessionPool{
+		dial:     dial,
+		sessions: make(map[string]*peerSession),
+		dialing:  make(map[string]*pendingDial),
+	}
+}
+
+func muxConfig(idleTimeout time.Duration) *mux.Config {
+	config := mux.DefaultConfig()
+	config.MaxStreams = maxStreamsPerSession
+	config.IdleTimeout = idleTimeout
+	return config
+}
+
+// get returns an open session to peer, dialing one if needed. If peer.ID
+// is set, the session must be authenticated as that ID.
+func (p *sessionPool) get(ctx context.Context, peer *dht.Node) (*peerSession, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	if ps := p.sessions[peer.Address]; ps != nil {
+		if !ps.IsClosed() {
+			ps.lastUsed = time.Now()
+			p.mu.Unlock()
+			return checkSessionID(ps, peer.ID)
+		}
+		delete(p.sessions, peer.Address)
+	}
+
+	d := p.dialing[peer.Address]
+	if d == nil {
+		if len(p.sessions) >= maxSessions && !p.evictIdle() {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("connection limit of %d peers reached", maxSessions)
+		}
+		d = &pendingDial{done: make(chan struct{})}
+		p.dialing[peer.Address] = d
+		p.mu.Unlock()
+
+		d.ps, d.err = p.dial(ctx, peer)
+
+		p.mu.Lock()
+		delete(p.dialing, peer.Address)
+		if d.err == nil && p.closed {
+			d.ps.Close()
+			d.ps, d.err = nil, errPoolClosed
+		}
+		if d.err == nil {
+			d.ps.lastUsed = time.Now()
+			p.sessions[peer.Address] = d.ps
+		}
+		p.mu.Unlock()
+		close(d.done)
+	} else {
+		p.mu.Unlock()
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return checkSessionID(d.ps, peer.ID)
+}
+
+func checkSessionID(ps *peerSession, expectedID []byte) (*peerSession, error) {
+	if expectedID != nil && !bytes.Equal(ps.remoteID, expectedID) {
+		return nil, fmt.Errorf("peer %s has identity %x, expected %x", ps.address, ps.remoteID, expectedID)
+	}
+	return ps, nil
+}
+
+// evictIdle closes the least recently used session without open streams.
+// It must be called with p.mu held.
+func (p *sessionPool) evictIdle() bool {
+	var oldest *peerSession
+	for _, ps := range p.sessions {
+		if ps.NumStreams() == 0 && (oldest == nil || ps.lastUsed.Before(oldest.lastUsed)) {
+			oldest = ps
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	delete(p.sessions, oldest.address)
+	oldest.Close()
+	return true
+}
+
+// remove drops ps if it is still the pooled session for its address.
+func (p *sessionPool) remove(ps *peerSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[ps.address] == ps {
+		delete(p.sessions, ps.address)
+	}
+	ps.Close()
+}
+
+// drop closes the session to address, if any.
+func (p *sessionPool) drop(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ps := p.sessions[address]; ps != nil {
+		delete(p.sessions, address)
+		ps.Close()
+	}
+}
+
+func (p *sessionPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	count := 0
+	for _, ps := range p.sessions {
+		if !ps.IsClosed() {
+			count++
+		}
+	}
+	return count
+}
+
+// closeAll closes every session and refuses new ones.
+func (p *sessionPool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for address, ps := range p.sessions {
+		ps.Close()
+		delete(p.sessions, address)
+	}
+}
+
+// dialSession connects to peer, authenticates it and exchanges HELLO on
+// the first stream of a new session.
+func (n *Node) dialSession(ctx context.Context, peer *dht.Node) (*peerSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	rawConn, err := dialer.DialContext(ctx, "tcp", peer.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", peer.Address, err)
+	}
+	conn, id, err := n.secureClient(ctx, rawConn, peer.ID)
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", peer.Address, err)
+	}
+
+	ps := &peerSession{
+		Session:  mux.Client(conn, muxConfig(sessionIdleTimeout)),
+		address:  peer.Address,
+		remoteID: id,
+	}
+	pc, err := ps.openConn(ctx)
+	if err == nil {
+		err = pc.sayHello()
+		pc.Close()
+	}
+	if err != nil {
+		ps.Close()
+		return nil, fmt.Errorf("failed to connect to peer %s: %w", peer.Address, err)
+	}
+	ps.hello = pc.hello
+	return ps, nil
+}
+
+// openConn opens a stream for one exchange. The stream is reset if ctx is
+// cancelled and times out after rpcTimeout.
+func (ps *peerSession) openConn(ctx context.Context) (*peerConn, error) {
+	st, err := ps.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(rpcTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	st.SetDeadline(deadline)
+
+	return newPeerConn(st, ps.remoteID, ps.hello, context.AfterFunc(ctx, st.Reset)), nil
+}
+
+// dialPeer opens a stream to peer on a pooled session. If peer.ID is set,
+// the remote identity must match it.
+func (n *Node) dialPeer(ctx context.Context, peer *dht.Node) (*peerConn, error) {
+	for attempt := 0; ; attempt++ {
+		ps, err := n.pool.get(ctx, peer)
+		if err != nil {
+			return nil, err
+		}
+		pc, err := ps.openConn(ctx)
+		if errors.Is(err, mux.ErrSessionClosed) && attempt == 0 {
+			// The session went away while idle; dial a fresh one.
+			n.pool.remove(ps)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stream to peer %s: %w", peer.Address, err)
+		}
+		return pc, nil
+	}
+}
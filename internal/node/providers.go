@@ -0,0 +1,204 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"meshfile/internal/dht"
+	"meshfile/internal/wire"
+	"sync"
+	"time"
+)
+
+const (
+	republishInterval = time.Hour
+	announceTimeout   = 30 * time.Second
+)
+
+// Provide announces that this node serves the content identified by key by
+// storing a provider record on the K nodes closest to it.
+func (n *Node) Provide(ctx context.Context, key []byte) error {
+	if n.dht == nil {
+		return errNotStarted
+	}
+	self := n.self()
+	n.dht.AddProvider(&dht.ProviderRecord{
+		Key:     key,
+		NodeID:  self.ID,
+		Address: self.Address,
+	})
+
+	nodes, err := n.Lookup(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to find nodes for key: %w", err)
+	}
+
+	req := &storeRequest{
+		Key:        key,
+		NodeID:     self.ID,
+		Address:    self.Address,
+		TTLSeconds: int64(dht.ProviderTTL / time.Second),
+	}
+
+	var wg sync.WaitGroup
+	stored := make(chan bool, len(nodes))
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node *dht.Node) {
+			defer wg.Done()
+			if err := n.store(ctx, node, req); err != nil {
+				log.Printf("Failed to store provider record on %s: %v", node.Address, err)
+				stored <- false
+				return
+			}
+			stored <- true
+		}(node)
+	}
+	wg.Wait()
+	close(stored)
+
+	for ok := range stored {
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("no node accepted the provider record")
+}
+
+// FindProviders looks up provider records for key, first locally and then
+// with an iterative FIND_VALUE that stops as soon as any peer returns
+// providers.
+func (n *Node) FindProviders(ctx context.Context, key []byte) ([]*dht.ProviderRecord, error) {
+	if n.dht == nil {
+		return nil, errNotStarted
+	}
+	if providers := n.remoteProviders(n.dht.GetProviders(key)); len(providers) > 0 {
+		return providers, nil
+	}
+
+	var mu sync.Mutex
+	var providers []*dht.ProviderRecord
+	_, err := n.iterativeLookup(ctx, dht.KeyID(key), func(ctx context.Context, contact *dht.Node) ([]*dht.Node, bool, error) {
+		value, err := n.findValue(ctx, contact, key)
+		if err != nil {
+			return nil, false, err
+		}
+		found := n.remoteProviders(value.Providers)
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rec := range found {
+			if bytes.Equal(rec.Key, key) {
+				providers = appendProvider(providers, rec)
+			}
+		}
+		return value.Nodes, len(providers) > 0, nil
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(providers) > 0 {
+		return providers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no providers found")
+}
+
+// remoteProviders filters out records that point at this node.
+func (n *Node) remoteProviders(records []*dht.ProviderRecord) []*dht.ProviderRecord {
+	var remote []*dht.ProviderRecord
+	for _, rec := range records {
+		if rec != nil && !bytes.Equal(rec.NodeID, n.dht.LocalID) {
+			remote = append(remote, rec)
+		}
+	}
+	return remote
+}
+
+func appendProvider(records []*dht.ProviderRecord, rec *dht.ProviderRecord) []*dht.ProviderRecord {
+	for _, existing := range records {
+		if bytes.Equal(existing.NodeID, rec.NodeID) {
+			return records
+		}
+	}
+	return append(records, rec)
+}
+
+// announceFile publishes a provider record for a shared file in the
+// background.
+func (n *Node) announceFile(hash []byte) {
+	ctx, cancel := context.WithTimeout(n.ctx, announceTimeout)
+	defer cancel()
+
+	if err := n.Provide(ctx, hash); err != nil {
+		log.Printf("Failed to announce file %x: %v", hash, err)
+	}
+}
+
+// announceFiles publishes provider records for every shared file.
+func (n *Node) announceFiles() {
+	for _, file := range n.ListFiles() {
+		n.announceFile(file.Hash)
+	}
+}
+
+// startRepublisher expires stale provider records and re-announces every
+// shared file before its records can expire on other nodes.
+func (n *Node) startRepublisher() {
+	ticker := time.NewTicker(republishInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.ctx.Done():
+			return
+		}
+		if removed := n.dht.ExpireProviders(); removed > 0 {
+			log.Printf("Expired %d provider records", removed)
+		}
+		n.announceFiles()
+	}
+}
+
+// handleStore only accepts records published by the authenticated peer
+// itself.
+func (n *Node) handleStore(peerID, payload []byte) (wire.Type, []byte, error) {
+	req, err := decodeStoreRequest(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(req.Key) == 0 || len(req.NodeID) != dht.IDLength || req.Address == "" || req.TTLSeconds <= 0 {
+		return 0, nil, fmt.Errorf("invalid provider record")
+	}
+	if !bytes.Equal(req.NodeID, peerID) {
+		return 0, nil, fmt.Errorf("provider record does not match peer identity")
+	}
+
+	err = n.dht.AddProvider(&dht.ProviderRecord{
+		Key:     req.Key,
+		NodeID:  req.NodeID,
+		Address: req.Address,
+		Expires: time.Now().Add(time.Duration(req.TTLSeconds) * time.Second),
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return wire.TypeStored, nil, nil
+}
+
+func (n *Node) handleFindValue(payload []byte) (wire.Type, []byte, error) {
+	key, err := decodeBytes(payload)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid FIND_VALUE request")
+	}
+
+	value := findValueResponse{Providers: n.dht.GetProviders(key)}
+	if len(value.Providers) == 0 {
+		value.Nodes = n.dht.FindClosestNodes(key, dht.K)
+	}
+	return wire.TypeValue, value.encode(), nil
+}
@@ -0,0 +1,174 @@
+package node
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"meshfile/internal/transfer"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// downloadState is the sidecar file kept next to a partial download. It
+// records the manifest being fetched and the chunks already written and
+// verified, so an interrupted download can pick up where it stopped. The
+// state file is written once when a download starts or resumes; chunks
+// finished after that are appended to a log next to it, one index per line.
+type downloadState struct {
+	Hash     []byte
+	Manifest *transfer.Manifest
+	Done     []uint64
+
+	path string
+	done map[uint64]bool
+	log  *os.File
+}
+
+func partPath(destPath string) string {
+	return destPath + ".part"
+}
+
+func statePath(destPath string) string {
+	return destPath + ".part.json"
+}
+
+func logPath(statePath string) string {
+	return statePath + ".log"
+}
+
+func newDownloadState(destPath string, hash []byte, manifest *transfer.Manifest) *downloadState {
+	return &downloadState{
+		Hash:     hash,
+		Manifest: manifest,
+		path:     statePath(destPath),
+		done:     make(map[uint64]bool),
+	}
+}
+
+// loadDownloadState returns the saved state for destPath, or nil if there
+// is none for this hash.
+func loadDownloadState(destPath string, hash []byte) (*downloadState, error) {
+	data, err := os.ReadFile(statePath(destPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read download state: %w", err)
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil || state.Manifest == nil {
+		return nil, nil
+	}
+	if !bytes.Equal(state.Hash, hash) || validateManifest(state.Manifest, hash) != nil {
+		return nil, nil
+	}
+
+	state.path = statePath(destPath)
+	state.done = make(map[uint64]bool, len(state.Done))
+	for _, index := range append(state.Done, readDoneLog(logPath(state.path))...) {
+		if index < uint64(len(state.Manifest.Chunks)) {
+			state.done[index] = true
+		}
+	}
+	return &state, nil
+}
+
+// readDoneLog returns the chunk indices in a done log. A line cut short by
+// a crash is skipped; verify catches any chunk logged ahead of its data.
+func readDoneLog(path string) []uint64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var done []uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if index, err := strconv.ParseUint(scanner.Text(), 10, 64); err == nil {
+			done = append(done, index)
+		}
+	}
+	return done
+}
+
+func (s *downloadState) isDone(index uint64) bool {
+	return s.done[index]
+}
+
+// markDone records a verified chunk by appending it to the done log.
+func (s *downloadState) markDone(index uint64) error {
+	s.done[index] = true
+	if s.log == nil {
+		return nil
+	}
+	if _, err := fmt.Fprintf(s.log, "%d\n", index); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+	return nil
+}
+
+// verify re-reads the chunks marked done from the partial file and forgets
+// any that no longer match, in case the state was saved ahead of the data.
+func (s *downloadState) verify(part io.ReaderAt) {
+	for index := range s.done {
+		info := s.Manifest.Chunks[index]
+		data := make([]byte, info.Size)
+		if _, err := part.ReadAt(data, info.Offset); err != nil {
+			delete(s.done, index)
+			continue
+		}
+		if sum := sha256.Sum256(data); !bytes.Equal(sum[:], info.Hash) {
+			delete(s.done, index)
+		}
+	}
+}
+
+// save writes the state, with every chunk done so far, to a temporary file
+// and renames it into place so a crash never leaves a truncated state file
+// behind. It then starts a fresh done log for markDone to append to.
+func (s *downloadState) save() error {
+	s.Done = s.Done[:0]
+	for index := range s.done {
+		s.Done = append(s.Done, index)
+	}
+	sort.Slice(s.Done, func(i, j int) bool { return s.Done[i] < s.Done[j] })
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+
+	s.close()
+	f, err := os.Create(logPath(s.path))
+	if err != nil {
+		return fmt.Errorf("failed to write download state: %w", err)
+	}
+	s.log = f
+	return nil
+}
+
+func (s *downloadState) close() {
+	if s.log != nil {
+		s.log.Close()
+		s.log = nil
+	}
+}
+
+func (s *downloadState) remove() {
+	s.close()
+	os.Remove(s.path)
+	os.Remove(logPath(s.path))
+}
@@ -0,0 +1,194 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"meshfile/internal/dht"
+	"meshfile/internal/wire"
+	"net"
+)
+
+// peerConn is one request/response exchange with a peer, carried on a
+// stream of that peer's session.
+type peerConn struct {
+	net.Conn
+	rw       *bufio.ReadWriter
+	remoteID []byte      // authenticated during the handshake
+	hello    *wire.Hello // the version and capabilities the peer agreed to
+	nextID   uint32
+	stop     func() bool
+}
+
+func newPeerConn(conn net.Conn, remoteID []byte, hello *wire.Hello, stop func() bool) *peerConn {
+	return &peerConn{
+		Conn:     conn,
+		rw:       bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		remoteID: remoteID,
+		hello:    hello,
+		stop:     stop,
+	}
+}
+
+func localHello() *wire.Hello {
+	return &wire.Hello{
+		MinVersion:   wire.MinVersion,
+		MaxVersion:   wire.Version,
+		Capabilities: []string{wire.CapDHT, wire.CapProviders, wire.CapTransfer},
+	}
+}
+
+// sayHello offers our version range; the peer answers with the version it
+// picked and its capabilities.
+func (pc *peerConn) sayHello() error {
+	local := localHello()
+	payload, err := pc.request(wire.TypeHello, local.Encode(), wire.TypeHello)
+	if err != nil {
+		return err
+	}
+	remote, err := wire.DecodeHello(payload)
+	if err != nil {
+		return err
+	}
+	if remote.MinVersion != remote.MaxVersion || remote.MaxVersion < local.MinVersion || remote.MaxVersion > local.MaxVersion {
+		return fmt.Errorf("peer chose unsupported protocol version %d", remote.MaxVersion)
+	}
+	pc.hello = remote
+	return nil
+}
+
+func (pc *peerConn) Close() error {
+	pc.stop()
+	return pc.Conn.Close()
+}
+
+// request sends one message and waits for the response to it. ERROR
+// responses are returned as errors.
+func (pc *peerConn) request(typ wire.Type, payload []byte, want wire.Type) ([]byte, error) {
+	id, err := pc.send(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	return pc.receive(id, typ, want)
+}
+
+// send writes a request and returns its request ID.
+func (pc *peerConn) send(typ wire.Type, payload []byte) (uint32, error) {
+	if pc.hello != nil && !pc.hello.Supports(capabilityFor(typ)) {
+		return 0, fmt.Errorf("peer does not support %s", typ)
+	}
+
+	pc.nextID++
+	id := pc.nextID
+	if err := wire.WriteFrame(pc.rw, &wire.Frame{Type: typ, RequestID: id, Payload: payload}); err != nil {
+		return 0, fmt.Errorf("write error: %w", err)
+	}
+	if err := pc.rw.Flush(); err != nil {
+		return 0, fmt.Errorf("flush error: %w", err)
+	}
+	return id, nil
+}
+
+// receive reads the next response to request id, which must be of type
+// want or ERROR.
+func (pc *peerConn) receive(id uint32, typ, want wire.Type) ([]byte, error) {
+	resp, err := wire.ReadFrame(pc.rw)
+	if err != nil {
+		return nil, fmt.Errorf("read error: %w", err)
+	}
+	if resp.RequestID != id {
+		return nil, fmt.Errorf("response to request %d does not match request %d", resp.RequestID, id)
+	}
+	switch resp.Type {
+	case want:
+		return resp.Payload, nil
+	case wire.TypeError:
+		return nil, fmt.Errorf("peer responded with error: %s", resp.Payload)
+	default:
+		return nil, fmt.Errorf("unexpected %s response to %s", resp.Type, typ)
+	}
+}
+
+// capabilityFor returns the HELLO capability a peer must advertise to
+// accept a request type.
+func capabilityFor(typ wire.Type) string {
+	switch typ {
+	case wire.TypeStore, wire.TypeFindValue:
+		return wire.CapProviders
+	case wire.TypeGetManifest, wire.TypeGetChunk, wire.TypeGetFile:
+		return wire.CapTransfer
+	default:
+		return wire.CapDHT
+	}
+}
+
+// findNode asks peer for the contacts it knows closest to target.
+func (n *Node) findNode(ctx context.Context, peer *dht.Node, target []byte) ([]*dht.Node, error) {
+	pc, err := n.dialPeer(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	payload, err := pc.request(wire.TypeFindNode, encodeBytes(target), wire.TypeNodes)
+	if err != nil {
+		return nil, err
+	}
+	d := wire.NewDecoder(payload)
+	nodes := decodeContacts(d)
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("invalid NODES response: %w", err)
+	}
+	return nodes, nil
+}
+
+// store asks peer to keep a provider record.
+func (n *Node) store(ctx context.Context, peer *dht.Node, req *storeRequest) error {
+	pc, err := n.dialPeer(ctx, peer)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	_, err = pc.request(wire.TypeStore, req.encode(), wire.TypeStored)
+	return err
+}
+
+// findValue asks peer for providers of key, falling back to the contacts
+// it knows closest to the key.
+func (n *Node) findValue(ctx context.Context, peer *dht.Node, key []byte) (*findValueResponse, error) {
+	pc, err := n.dialPeer(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	payload, err := pc.request(wire.TypeFindValue, encodeBytes(key), wire.TypeValue)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFindValueResponse(key, payload)
+}
+
+// fetchData sends a request answered with DATA. Data larger than maxSize
+// is rejected.
+func (n *Node) fetchData(ctx context.Context, peer *dht.Node, typ wire.Type, payload []byte, maxSize int64) (*dataResponse, error) {
+	pc, err := n.dialPeer(ctx, peer)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	resp, err := pc.request(typ, payload, wire.TypeData)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := decodeDataResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(dr.data)) > maxSize {
+		return nil, fmt.Errorf("response of %d bytes exceeds limit of %d", len(dr.data), maxSize)
+	}
+	return dr, nil
+}
@@ -0,0 +1,134 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"meshfile/internal/dht"
+	"net"
+	"time"
+)
+
+// Peer connections use mutual TLS 1.3 with self-signed certificates over
+// the node identity keys. Certificates are not chained to any authority;
+// instead each side derives the other's DHT ID from the certificate key and
+// checks it against the ID it expected to reach or that the peer claims.
+
+func (n *Node) initializeTLS() error {
+	cert, err := identityCertificate(n.identity.PrivateKey())
+	if err != nil {
+		return err
+	}
+	n.tlsCert = cert
+	return nil
+}
+
+func identityCertificate(privateKey ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate certificate serial: %w", err)
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("%x", dht.IDFromPublicKey(publicKey))},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, privateKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create identity certificate: %w", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: privateKey}, nil
+}
+
+func (n *Node) serverTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:          []tls.Certificate{n.tlsCert},
+		ClientAuth:            tls.RequireAnyClientCert,
+		MinVersion:            tls.VersionTLS13,
+		VerifyPeerCertificate: verifyIdentityCertificate(nil),
+	}
+}
+
+// clientTLSConfig accepts any valid identity certificate when expectedID
+// is nil, such as for bootstrap peers known only by address.
+func (n *Node) clientTLSConfig(expectedID []byte) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{n.tlsCert},
+		MinVersion:   tls.VersionTLS13,
+		// Chain verification is replaced by the identity check below.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyIdentityCertificate(expectedID),
+	}
+}
+
+func verifyIdentityCertificate(expectedID []byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) != 1 {
+			return fmt.Errorf("expected exactly one peer certificate, got %d", len(rawCerts))
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("invalid peer certificate: %w", err)
+		}
+		if _, ok := cert.PublicKey.(ed25519.PublicKey); !ok {
+			return fmt.Errorf("peer certificate does not carry an Ed25519 identity key")
+		}
+		if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+			return fmt.Errorf("peer certificate is not self-signed: %w", err)
+		}
+		if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return fmt.Errorf("peer certificate is not valid at this time")
+		}
+		if expectedID != nil {
+			if id := certificateID(cert); !bytes.Equal(id, expectedID) {
+				return fmt.Errorf("peer identity %x does not match expected ID %x", id, expectedID)
+			}
+		}
+		return nil
+	}
+}
+
+func certificateID(cert *x509.Certificate) []byte {
+	return dht.IDFromPublicKey(cert.PublicKey.(ed25519.PublicKey))
+}
+
+// secureClient runs the client side of the handshake and returns the
+// authenticated DHT ID of the remote node.
+func (n *Node) secureClient(ctx context.Context, conn net.Conn, expectedID []byte) (*tls.Conn, []byte, error) {
+	tlsConn := tls.Client(conn, n.clientTLSConfig(expectedID))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, nil, fmt.Errorf("secure handshake failed: %w", err)
+	}
+	return tlsConn, remoteID(tlsConn), nil
+}
+
+// secureServer runs the server side of the handshake and returns the
+// authenticated DHT ID of the remote node.
+func (n *Node) secureServer(conn net.Conn) (*tls.Conn, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	tlsConn := tls.Server(conn, n.serverTLSConfig())
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, nil, fmt.Errorf("secure handshake failed: %w", err)
+	}
+	return tlsConn, remoteID(tlsConn), nil
+}
+
+func remoteID(conn *tls.Conn) []byte {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certificateID(certs[0])
+}
@@ -0,0 +1,163 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"meshfile/internal/dht"
+	"meshfile/internal/transfer"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	stateFileName     = "state.json"
+	stateSaveInterval = time.Minute
+)
+
+// savedState is what a node keeps in its data directory between runs: the
+// shared-file catalog, the peer table and the routing table. Chunk data
+// lives in the block store, and partial downloads keep their own state
+// next to the file being written.
+type savedState struct {
+	Files    map[string]*FileInfo
+	Peers    []Peer
+	Contacts []*dht.Node
+}
+
+func (n *Node) statePath() string {
+	return filepath.Join(n.config.DataDir, stateFileName)
+}
+
+// persistent reports whether the node has a data directory to save its
+// state in.
+func (n *Node) persistent() bool {
+	return n.config.DataDir != "" && n.blocks != nil
+}
+
+// loadState restores the state saved by a previous run. The store is
+// verified first; files whose blocks are gone or corrupt are dropped from
+// the catalog, and blocks no file refers to any more are collected. A state file that cannot be read or
+// parsed is left alone, blocks included, and fails Start.
+func (n *Node) loadState() error {
+	data, err := os.ReadFile(n.statePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read saved state: %w", err)
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse saved state %s: %w", n.statePath(), err)
+	}
+
+	if bad, err := n.blocks.Verify(); err != nil {
+		return fmt.Errorf("failed to verify block store: %w", err)
+	} else if len(bad) > 0 {
+		log.Printf("Removed %d corrupt blocks", len(bad))
+	}
+
+	files := make(map[string]*FileInfo)
+	for path, file := range state.Files {
+		if err := n.restoreFile(file); err != nil {
+			log.Printf("Dropping shared file %s: %v", path, err)
+			continue
+		}
+		files[path] = file
+	}
+	if removed, err := n.blocks.GC(); err != nil {
+		log.Printf("Block store GC failed: %v", err)
+	} else if removed > 0 {
+		log.Printf("Removed %d unreferenced blocks", removed)
+	}
+
+	for _, contact := range state.Contacts {
+		n.dht.AddNode(contact)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for path, file := range files {
+		n.files[path] = file
+	}
+	for _, peer := range state.Peers {
+		n.peers[peer.Address] = &peer
+	}
+	log.Printf("Restored %d files, %d peers and %d contacts", len(files), len(state.Peers), len(state.Contacts))
+	return nil
+}
+
+// restoreFile takes references to a saved file's blocks and rebuilds its
+// Merkle tree.
+func (n *Node) restoreFile(file *FileInfo) error {
+	manifest := transfer.Manifest{Size: file.Size, Chunks: file.Chunks}
+	if err := validateManifest(&manifest, file.Hash); err != nil {
+		return err
+	}
+	for i, chunk := range file.Chunks {
+		if err := n.blocks.Ref(chunk.Hash); err != nil {
+			for _, taken := range file.Chunks[:i] {
+				n.blocks.Release(taken.Hash)
+			}
+			return fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+	file.tree = transfer.NewMerkleTree(manifest.ChunkHashes())
+	return nil
+}
+
+// saveState writes the current state through a temporary file so a crash
+// leaves either the old or the new state on disk.
+func (n *Node) saveState() error {
+	if !n.persistent() {
+		return nil
+	}
+
+	n.mu.RLock()
+	state := savedState{Files: make(map[string]*FileInfo, len(n.files))}
+	for path, file := range n.files {
+		copied := *file
+		state.Files[path] = &copied
+	}
+	for _, peer := range n.peers {
+		state.Peers = append(state.Peers, *peer)
+	}
+	n.mu.RUnlock()
+	state.Contacts = n.dht.AllNodes()
+
+	n.saveMu.Lock()
+	defer n.saveMu.Unlock()
+	data, err := json.MarshalIndent(&state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tmp := n.statePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	if err := os.Rename(tmp, n.statePath()); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+// startStateSaver saves the node's state on a schedule until it stops.
+func (n *Node) startStateSaver() {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := n.saveState(); err != nil {
+				log.Printf("Failed to save state: %v", err)
+			}
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"meshfile/internal/dht"
+	"meshfile/internal/transfer"
+	"time"
+)
+
+// FileReader reads a file identified by its content hash in order. Files
+// shared by this node are read from the block store; anything else is
+// fetched from the providers one chunk at a time as the reader advances,
+// each chunk checked against the file's Merkle root before it is returned.
+type FileReader struct {
+	Name  string // empty unless the file is shared by this node
+	Size  int64
+	Added time.Time // zero unless the file is shared by this node
+
+	local *fileReader
+
+	n         *Node
+	ctx       context.Context
+	cancel    context.CancelFunc
+	hash      []byte
+	manifest  *transfer.Manifest
+	providers []*dht.ProviderRecord
+	next      int    // index of the next chunk to fetch
+	buf       []byte // unread part of the last fetched chunk
+}
+
+// OpenFile returns a reader for the file with the given hash, resolving
+// remote files to their manifest and providers up front. Cancelling ctx or
+// stopping the node ends a remote read; Close releases the reader.
+func (n *Node) OpenFile(ctx context.Context, hash []byte) (*FileReader, error) {
+	if n.ctx == nil {
+		return nil, errNotStarted
+	}
+	if _, file, ok := n.fileByHash(hash); ok {
+		return &FileReader{Name: file.Name, Size: file.Size, Added: file.Added, local: n.newFileReader(file)}, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(n.ctx, cancel)
+	r := &FileReader{n: n, ctx: ctx, hash: hash, cancel: func() { stop(); cancel() }}
+
+	providers, err := n.FindProviders(ctx, hash)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("no peers found for file %x: %w", hash, err)
+	}
+	manifest, err := n.fetchManifest(ctx, providers, hash)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	r.Size, r.manifest, r.providers = manifest.Size, manifest, providers
+	return r, nil
+}
+
+// Local reports whether the file is read from this node's block store. Only
+// local readers can seek.
+func (r *FileReader) Local() bool {
+	return r.local != nil
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.local != nil {
+		return r.local.Read(p)
+	}
+	if len(r.buf) == 0 {
+		if r.next >= len(r.manifest.Chunks) {
+			return 0, io.EOF
+		}
+		data, err := r.fetchNext()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = data
+		r.next++
+	}
+	read := copy(p, r.buf)
+	r.buf = r.buf[read:]
+	return read, nil
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	if r.local == nil {
+		return 0, errors.New("cannot seek in a file being fetched from peers")
+	}
+	return r.local.Seek(offset, whence)
+}
+
+func (r *FileReader) Close() error {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return nil
+}
+
+// fetchNext fetches the next chunk, trying each provider in turn.
+func (r *FileReader) fetchNext() ([]byte, error) {
+	info := r.manifest.Chunks[r.next]
+	out := &chunkBuffer{offset: info.Offset, data: make([]byte, info.Size)}
+
+	var lastErr error
+	for _, provider := range r.providers {
+		err := r.n.fetchChunk(r.ctx, providerContact(provider), r.hash, len(r.manifest.Chunks), info, out)
+		if err == nil {
+			return out.data, nil
+		}
+		if r.ctx.Err() != nil {
+			return nil, r.ctx.Err()
+		}
+		log.Printf("Chunk %d of %x from %s failed: %v", info.Index, r.hash, provider.Address, err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("chunk %d failed on every provider: %w", info.Index, lastErr)
+}
+
+// chunkBuffer lets fetchChunk write a chunk, addressed by its offset in the
+// file, into memory.
+type chunkBuffer struct {
+	offset int64
+	data   []byte
+}
+
+func (b *chunkBuffer) WriteAt(p []byte, off int64) (int, error) {
+	start := off - b.offset
+	if start < 0 || start+int64(len(p)) > int64(len(b.data)) {
+		return 0, fmt.Errorf("write at %d outside chunk at %d", off, b.offset)
+	}
+	return copy(b.data[start:], p), nil
+}
@@ -0,0 +1,272 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"meshfile/internal/dht"
+	"meshfile/internal/transfer"
+	"meshfile/internal/wire"
+	"sync"
+)
+
+const (
+	maxManifestSize      = 16 * 1024 * 1024
+	chunksPerProvider    = 2 // concurrent chunk requests per provider
+	maxProviderFailures  = 3 // consecutive failures before a provider is dropped
+	maxChunkAttemptCount = 5
+)
+
+type chunkJob struct {
+	info     transfer.ChunkInfo
+	attempts int
+	failedOn map[string]bool
+}
+
+type swarmProvider struct {
+	contact  *dht.Node
+	inFlight int
+	failures int
+	dropped  bool
+}
+
+type chunkResult struct {
+	job      *chunkJob
+	provider *swarmProvider
+	err      error
+}
+
+// fetchManifest asks the providers in turn for the chunk manifest of a file.
+func (n *Node) fetchManifest(ctx context.Context, providers []*dht.ProviderRecord, hash []byte) (*transfer.Manifest, error) {
+	var lastErr error
+	for _, provider := range providers {
+		dr, err := n.fetchData(ctx, providerContact(provider), wire.TypeGetManifest, encodeBytes(hash), maxManifestSize)
+		if err == nil && !bytes.Equal(dr.hash, hash) {
+			err = fmt.Errorf("peer sent manifest for %x instead of %x", dr.hash, hash)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var manifest transfer.Manifest
+		if err := json.Unmarshal(dr.data, &manifest); err != nil {
+			lastErr = fmt.Errorf("invalid manifest: %w", err)
+			continue
+		}
+		if err := validateManifest(&manifest, hash); err != nil {
+			lastErr = err
+			continue
+		}
+		return &manifest, nil
+	}
+	return nil, fmt.Errorf("failed to fetch manifest: %w", lastErr)
+}
+
+// providerContact returns the contact to dial for a provider record; the
+// peer must prove it holds the identity that published the record.
+func providerContact(rec *dht.ProviderRecord) *dht.Node {
+	return &dht.Node{ID: rec.NodeID, Address: rec.Address}
+}
+
+// validateManifest checks that the chunk hashes build the Merkle root the
+// file is identified by, and that the chunks tile the file exactly so a bad
+// manifest cannot make the downloader write outside the file.
+func validateManifest(manifest *transfer.Manifest, hash []byte) error {
+	if !bytes.Equal(transfer.MerkleRoot(manifest.ChunkHashes()), hash) {
+		return fmt.Errorf("manifest does not match file hash %x", hash)
+	}
+
+	var offset int64
+	for i, chunk := range manifest.Chunks {
+		if chunk.Index != uint64(i) || chunk.Offset != offset || chunk.Size <= 0 || chunk.Size > transfer.MaxChunkSize || len(chunk.Hash) != sha256.Size {
+			return fmt.Errorf("invalid manifest entry %d", i)
+		}
+		offset += chunk.Size
+	}
+	if offset != manifest.Size {
+		return fmt.Errorf("manifest chunks cover %d bytes, expected %d", offset, manifest.Size)
+	}
+	return nil
+}
+
+// swarmDownload fetches every chunk not yet recorded in state from the
+// given providers in parallel and writes each one to out once its hash
+// checks out. A chunk that fails is retried on a provider it has not failed
+// on. It only returns once every fetch it started has finished, so nothing
+// writes to out afterwards.
+func (n *Node) swarmDownload(ctx context.Context, providers []*dht.ProviderRecord, hash []byte, state *downloadState, out io.WriterAt) error {
+	var fetches sync.WaitGroup
+	defer fetches.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var pool []*swarmProvider
+	for _, provider := range providers {
+		pool = append(pool, &swarmProvider{contact: providerContact(provider)})
+	}
+
+	var queue []*chunkJob
+	for _, info := range state.Manifest.Chunks {
+		if !state.isDone(info.Index) {
+			queue = append(queue, &chunkJob{info: info, failedOn: make(map[string]bool)})
+		}
+	}
+
+	// Buffered for every chunk, so fetches still running when we return
+	// early never block on sending their result.
+	results := make(chan chunkResult, len(queue))
+	remaining := len(queue)
+	inFlight := 0
+
+	for remaining > 0 {
+		queue = n.assignChunks(ctx, pool, queue, hash, len(state.Manifest.Chunks), out, results, &inFlight, &fetches)
+		if inFlight == 0 {
+			return fmt.Errorf("no provider left for %d remaining chunks", remaining)
+		}
+
+		res := <-results
+		inFlight--
+		res.provider.inFlight--
+
+		if res.err == nil {
+			res.provider.failures = 0
+			remaining--
+			if err := state.markDone(res.job.info.Index); err != nil {
+				log.Printf("Failed to save download state: %v", err)
+			}
+			continue
+		}
+
+		log.Printf("Chunk %d of %x from %s failed: %v", res.job.info.Index, hash, res.provider.contact.Address, res.err)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		res.job.attempts++
+		res.job.failedOn[res.provider.contact.Address] = true
+		if res.job.attempts >= maxChunkAttemptCount {
+			return fmt.Errorf("chunk %d failed after %d attempts: %w", res.job.info.Index, res.job.attempts, res.err)
+		}
+		if res.provider.failures++; res.provider.failures >= maxProviderFailures {
+			res.provider.dropped = true
+		}
+		queue = append([]*chunkJob{res.job}, queue...)
+	}
+	return nil
+}
+
+// assignChunks hands queued chunks to providers with free slots, preferring
+// providers the chunk has not already failed on. It returns the chunks that
+// are still waiting.
+func (n *Node) assignChunks(ctx context.Context, pool []*swarmProvider, queue []*chunkJob, hash []byte, chunkCount int, out io.WriterAt, results chan<- chunkResult, inFlight *int, fetches *sync.WaitGroup) []*chunkJob {
+	var waiting []*chunkJob
+	for _, job := range queue {
+		provider := pickProvider(pool, job)
+		if provider == nil {
+			waiting = append(waiting, job)
+			continue
+		}
+		provider.inFlight++
+		*inFlight++
+		fetches.Add(1)
+		go func(job *chunkJob, provider *swarmProvider) {
+			defer fetches.Done()
+			err := n.fetchChunk(ctx, provider.contact, hash, chunkCount, job.info, out)
+			results <- chunkResult{job: job, provider: provider, err: err}
+		}(job, provider)
+	}
+	return waiting
+}
+
+func pickProvider(pool []*swarmProvider, job *chunkJob) *swarmProvider {
+	var fallback *swarmProvider
+	for _, provider := range pool {
+		if provider.dropped || provider.inFlight >= chunksPerProvider {
+			continue
+		}
+		if !job.failedOn[provider.contact.Address] {
+			return provider
+		}
+		if fallback == nil {
+			fallback = provider
+		}
+	}
+	// Only reuse a provider the chunk failed on if every live provider has
+	// already been tried.
+	for _, provider := range pool {
+		if !provider.dropped && !job.failedOn[provider.contact.Address] {
+			return nil
+		}
+	}
+	return fallback
+}
+
+// fetchChunk downloads one chunk and checks it against the file's Merkle
+// root using the inclusion proof served with it before writing it out.
+func (n *Node) fetchChunk(ctx context.Context, peer *dht.Node, hash []byte, chunkCount int, info transfer.ChunkInfo, out io.WriterAt) error {
+	dr, err := n.fetchData(ctx, peer, wire.TypeGetChunk, encodeChunkRequest(hash, info.Index), info.Size)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(dr.data)
+	if int64(len(dr.data)) != info.Size || !bytes.Equal(sum[:], info.Hash) || !bytes.Equal(dr.hash, info.Hash) {
+		return fmt.Errorf("chunk hash mismatch")
+	}
+	if !transfer.VerifyProof(hash, sum[:], info.Index, uint64(chunkCount), dr.proof) {
+		return fmt.Errorf("chunk inclusion proof does not match file hash")
+	}
+	if _, err := out.WriteAt(dr.data, info.Offset); err != nil {
+		return fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return nil
+}
+
+func (n *Node) handleGetManifest(payload []byte) (wire.Type, []byte, error) {
+	hash, err := decodeBytes(payload)
+	if err != nil || len(hash) == 0 {
+		return 0, nil, fmt.Errorf("invalid file hash")
+	}
+	_, fileInfo, ok := n.fileByHash(hash)
+	if !ok {
+		return 0, nil, fmt.Errorf("file not found")
+	}
+
+	manifest := transfer.Manifest{Size: fileInfo.Size, Chunks: fileInfo.Chunks}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		log.Printf("Manifest marshal error: %v", err)
+		return 0, nil, fmt.Errorf("internal error")
+	}
+	return wire.TypeData, (&dataResponse{hash: fileInfo.Hash, data: data}).encode(), nil
+}
+
+func (n *Node) handleGetChunk(payload []byte) (wire.Type, []byte, error) {
+	hash, index, err := decodeChunkRequest(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	_, fileInfo, ok := n.fileByHash(hash)
+	if !ok {
+		return 0, nil, fmt.Errorf("file not found")
+	}
+	if index >= uint64(len(fileInfo.Chunks)) {
+		return 0, nil, fmt.Errorf("chunk index out of range")
+	}
+	proof, err := fileInfo.tree.Proof(index)
+	if err != nil {
+		return 0, nil, fmt.Errorf("chunk index out of range")
+	}
+
+	chunk := fileInfo.Chunks[index]
+	data, err := n.blocks.Get(chunk.Hash)
+	if err != nil {
+		log.Printf("GET_CHUNK error: %v", err)
+		return 0, nil, fmt.Errorf("chunk unavailable")
+	}
+	return wire.TypeData, (&dataResponse{hash: chunk.Hash, proof: proof, data: data}).encode(), nil
+}
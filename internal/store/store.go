@@ -0,0 +1,255 @@
+// Package store keeps file chunks as content-addressed blocks on disk.
+//
+// Each block is stored once under the hex SHA-256 of its data, so files
+// that share chunks share blocks. Blocks are reference counted by the files
+// that use them and deleted when the last reference is released; GC sweeps
+// the ones left without references, such as after a restart.
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var (
+	ErrNotFound = errors.New("block not found")
+	ErrCorrupt  = errors.New("block does not match its hash")
+)
+
+// Store is a directory of blocks. Reference counts live in memory: blocks
+// found on disk when the store is opened start unreferenced until their
+// owners take references again with Ref.
+type Store struct {
+	dir string
+
+	mu   sync.Mutex
+	refs map[string]int // hex hash -> references; present for every block on disk
+}
+
+// Open opens the block store in dir, creating it if needed.
+func Open(dir string) (*Store, error) {
+	s := &Store{dir: dir, refs: make(map[string]int)}
+	if err := os.MkdirAll(s.blockDir(), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create block store: %w", err)
+	}
+
+	err := filepath.WalkDir(s.blockDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if key, ok := keyFromName(d.Name()); ok {
+			s.refs[key] = 0
+		} else {
+			// Left over from an interrupted Put.
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan block store: %w", err)
+	}
+	return s, nil
+}
+
+// Dir returns the directory the store lives in.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Put stores data as a block if it is not stored already, takes a
+// reference to it and returns its hash.
+func (s *Store) Put(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.refs[key]; !ok {
+		if err := s.write(key, data); err != nil {
+			return nil, err
+		}
+	}
+	s.refs[key]++
+	return sum[:], nil
+}
+
+// write puts the block in place through a temporary file so a crash never
+// leaves a partial block under its final name.
+func (s *Store) write(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create block directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "put-*")
+	if err != nil {
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write block: %w", err)
+	}
+	return nil
+}
+
+// Get reads the block with the given hash, checking that its data still
+// hashes to it.
+func (s *Store) Get(hash []byte) ([]byte, error) {
+	data, err := os.ReadFile(s.path(hex.EncodeToString(hash)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block: %w", err)
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], hash) {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+// Has reports whether the block is stored.
+func (s *Store) Has(hash []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.refs[hex.EncodeToString(hash)]
+	return ok
+}
+
+// Ref takes another reference to a stored block.
+func (s *Store) Ref(hash []byte) error {
+	key := hex.EncodeToString(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.refs[key]; !ok {
+		return ErrNotFound
+	}
+	s.refs[key]++
+	return nil
+}
+
+// Release drops a reference taken by Put or Ref and deletes the block once
+// nothing refers to it any more.
+func (s *Store) Release(hash []byte) error {
+	key := hex.EncodeToString(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs[key] == 0 {
+		return nil
+	}
+	if s.refs[key]--; s.refs[key] > 0 {
+		return nil
+	}
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove block %s: %w", key, err)
+	}
+	delete(s.refs, key)
+	return nil
+}
+
+// Refs returns the number of references to a block.
+func (s *Store) Refs(hash []byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refs[hex.EncodeToString(hash)]
+}
+
+// Len returns the number of stored blocks.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.refs)
+}
+
+// GC deletes every block without references and returns how many it
+// removed.
+func (s *Store) GC() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for key, refs := range s.refs {
+		if refs > 0 {
+			continue
+		}
+		if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("failed to remove block %s: %w", key, err)
+		}
+		delete(s.refs, key)
+		removed++
+	}
+	return removed, nil
+}
+
+// Verify re-hashes every block and deletes those that are missing or no
+// longer match their hash. It returns the hashes of the blocks it dropped
+// so their owners can fetch them again.
+func (s *Store) Verify() ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var bad [][]byte
+	for key := range s.refs {
+		hash, _ := hex.DecodeString(key)
+		data, err := os.ReadFile(s.path(key))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return bad, fmt.Errorf("failed to read block %s: %w", key, err)
+		}
+		if sum := sha256.Sum256(data); err == nil && bytes.Equal(sum[:], hash) {
+			continue
+		}
+		if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return bad, fmt.Errorf("failed to remove block %s: %w", key, err)
+		}
+		delete(s.refs, key)
+		bad = append(bad, hash)
+	}
+	return bad, nil
+}
+
+func (s *Store) blockDir() string {
+	return filepath.Join(s.dir, "blocks")
+}
+
+// path spreads blocks over subdirectories named after the first byte of
+// their hash to keep directories small.
+func (s *Store) path(key string) string {
+	if len(key) < 2 {
+		return filepath.Join(s.blockDir(), key)
+	}
+	return filepath.Join(s.blockDir(), key[:2], key)
+}
+
+func keyFromName(name string) (string, bool) {
+	hash, err := hex.DecodeString(name)
+	if err != nil || len(hash) != sha256.Size {
+		return "", false
+	}
+	return name, true
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestPutGet(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	data := []byte("block data")
+	hash, err := s.Put(data)
+	if err != nil {
+		t.Fatalf("Failed to put block: %v", err)
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(hash, sum[:]) {
+		t.Fatalf("Expected hash %x, got %x", sum, hash)
+	}
+
+	got, err := s.Get(hash)
+	if err != nil {
+		t.Fatalf("Failed to get block: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+
+	missing := sha256.Sum256([]byte("missing"))
+	if _, err := s.Get(missing[:]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPutDeduplicatesAndCountsReferences(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	first, _ := s.Put([]byte("shared"))
+	second, _ := s.Put([]byte("shared"))
+	if !bytes.Equal(first, second) || s.Len() != 1 {
+		t.Fatalf("Expected one shared block, got %d", s.Len())
+	}
+	if refs := s.Refs(first); refs != 2 {
+		t.Errorf("Expected 2 references, got %d", refs)
+	}
+}
+
+func TestReleaseDeletesUnreferencedBlocks(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+
+	shared, _ := s.Put([]byte("shared"))
+	s.Put([]byte("shared"))
+	dropped, _ := s.Put([]byte("dropped"))
+
+	if err := s.Release(dropped); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if err := s.Release(shared); err != nil {
+		t.Fatalf("Release failed: %v", err)
+	}
+	if s.Has(dropped) || !s.Has(shared) {
+		t.Errorf("Expected only the unreferenced block to be removed")
+	}
+	if _, err := s.Get(dropped); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected released block to be gone from disk, got %v", err)
+	}
+}
+
+func TestGCRemovesUnreferencedBlocks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	kept, _ := s.Put([]byte("kept"))
+	dropped, _ := s.Put([]byte("dropped"))
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if err := reopened.Ref(kept); err != nil {
+		t.Fatalf("Failed to reference block: %v", err)
+	}
+	removed, err := reopened.GC()
+	if err != nil {
+		t.Fatalf("GC failed: %v", err)
+	}
+	if removed != 1 || reopened.Has(dropped) || !reopened.Has(kept) {
+		t.Errorf("Expected only the unreferenced block to be removed, removed %d", removed)
+	}
+	if _, err := reopened.Get(dropped); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected unreferenced block to be gone from disk, got %v", err)
+	}
+}
+
+func TestOpenFindsExistingBlocks(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	hash, _ := s.Put([]byte("persisted"))
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if !reopened.Has(hash) || reopened.Refs(hash) != 0 {
+		t.Fatalf("Expected reopened store to hold the block without references")
+	}
+	if err := reopened.Ref(hash); err != nil {
+		t.Fatalf("Failed to reference block: %v", err)
+	}
+	if removed, _ := reopened.GC(); removed != 0 {
+		t.Errorf("GC removed a referenced block")
+	}
+}
+
+func TestVerifyDropsCorruptBlocks(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	good, _ := s.Put([]byte("good"))
+	bad, _ := s.Put([]byte("bad"))
+	if err := os.WriteFile(s.path(hex.EncodeToString(bad)), []byte("tampered"), 0600); err != nil {
+		t.Fatalf("Failed to corrupt block: %v", err)
+	}
+
+	if _, err := s.Get(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Expected ErrCorrupt, got %v", err)
+	}
+
+	dropped, err := s.Verify()
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if len(dropped) != 1 || !bytes.Equal(dropped[0], bad) {
+		t.Fatalf("Expected only the corrupt block to be dropped, got %x", dropped)
+	}
+	if s.Has(bad) || !s.Has(good) {
+		t.Errorf("Expected corrupt block removed and good block kept")
+	}
+}
@@ -0,0 +1,127 @@
+package transfer
+
+import "fmt"
+
+// MaxChunkSize bounds the chunk size any chunker may produce, so peers can
+// reject oversized chunks before reading them.
+const MaxChunkSize = 4 * ChunkSize
+
+// Chunker decides where chunk boundaries fall.
+type Chunker interface {
+	// MaxSize is the largest chunk the chunker produces.
+	MaxSize() int
+	// Cut returns the length of the chunk at the start of data. data holds
+	// MaxSize bytes unless the end of the file is nearer.
+	Cut(data []byte) int
+}
+
+// FixedChunker cuts chunks of a constant size.
+type FixedChunker struct {
+	Size int
+}
+
+func (c FixedChunker) MaxSize() int {
+	return c.Size
+}
+
+func (c FixedChunker) Cut(data []byte) int {
+	if len(data) < c.Size {
+		return len(data)
+	}
+	return c.Size
+}
+
+// FastCDC is a content-defined chunker using a gear rolling hash with
+// normalized chunking. Boundaries depend only on nearby content, so an
+// insertion or deletion only changes the chunks around it.
+type FastCDC struct {
+	Min, Avg, Max int
+	maskS, maskL  uint64
+}
+
+// NewFastCDC returns a chunker producing chunks between min and max bytes
+// with an average close to avg, which must be a power of two.
+func NewFastCDC(min, avg, max int) (*FastCDC, error) {
+	if min <= 0 || min >= avg || avg >= max || max > MaxChunkSize || avg < 64 || avg&(avg-1) != 0 {
+		return nil, fmt.Errorf("invalid FastCDC sizes %d/%d/%d", min, avg, max)
+	}
+	bits := 0
+	for 1<<bits < avg {
+		bits++
+	}
+	// Normalized chunking: a stricter mask before the average size and a
+	// looser one after it pulls chunk sizes towards the average.
+	return &FastCDC{
+		Min:   min,
+		Avg:   avg,
+		Max:   max,
+		maskS: topBits(bits + 2),
+		maskL: topBits(bits - 2),
+	}, nil
+}
+
+// DefaultFastCDC returns a FastCDC chunker averaging ChunkSize.
+func DefaultFastCDC() *FastCDC {
+	c, err := NewFastCDC(ChunkSize/4, ChunkSize, MaxChunkSize)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+func (c *FastCDC) MaxSize() int {
+	return c.Max
+}
+
+func (c *FastCDC) Cut(data []byte) int {
+	n := len(data)
+	if n <= c.Min {
+		return n
+	}
+	if n > c.Max {
+		n = c.Max
+	}
+	normal := c.Avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// topBits returns a mask of the n most significant bits. The high bits of
+// the gear hash depend on the last 64 bytes, the low bits on far fewer.
+func topBits(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// gearTable maps bytes to random 64-bit values. It is derived from a fixed
+// seed because chunk boundaries, and therefore file IDs, depend on it; it
+// must never change.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x6d657368_66696c65) // "meshfile"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
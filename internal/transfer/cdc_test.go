@@ -0,0 +1,75 @@
+package transfer
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func chunkHashes(t *testing.T, data []byte, chunker Chunker) []ChunkInfo {
+	t.Helper()
+	fc := NewFileChunker(bytes.NewReader(data), int64(len(data)))
+	fc.Chunker = chunker
+	if err := fc.Scan(nil); err != nil {
+		t.Fatalf("Failed to scan data: %v", err)
+	}
+	return fc.Infos
+}
+
+func TestFastCDCChunkSizes(t *testing.T) {
+	data := make([]byte, 6*ChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	cdc := DefaultFastCDC()
+	infos := chunkHashes(t, data, cdc)
+
+	var total int64
+	for i, info := range infos {
+		if info.Size > int64(cdc.Max) || (info.Size < int64(cdc.Min) && i != len(infos)-1) {
+			t.Errorf("Chunk %d has size %d outside [%d, %d]", i, info.Size, cdc.Min, cdc.Max)
+		}
+		total += info.Size
+	}
+	if total != int64(len(data)) {
+		t.Errorf("Chunks cover %d bytes, expected %d", total, len(data))
+	}
+}
+
+func TestFastCDCInsertionKeepsLaterChunks(t *testing.T) {
+	original := make([]byte, 8*ChunkSize)
+	rand.New(rand.NewSource(2)).Read(original)
+	edited := append([]byte{original[0], 0x42}, original[1:]...)
+
+	before := chunkHashes(t, original, DefaultFastCDC())
+	after := chunkHashes(t, edited, DefaultFastCDC())
+
+	known := make(map[string]bool)
+	for _, info := range before {
+		known[string(info.Hash)] = true
+	}
+	shared := 0
+	for _, info := range after {
+		if known[string(info.Hash)] {
+			shared++
+		}
+	}
+	if shared < len(before)-1 {
+		t.Errorf("Expected all but the first chunk to be reused, %d of %d shared", shared, len(before))
+	}
+
+	// For comparison, fixed-size chunks all shift.
+	fixedBefore := chunkHashes(t, original, nil)
+	fixedAfter := chunkHashes(t, edited, nil)
+	if bytes.Equal(fixedBefore[len(fixedBefore)-1].Hash, fixedAfter[len(fixedAfter)-1].Hash) {
+		t.Errorf("Expected fixed-size chunks to shift after an insertion")
+	}
+}
+
+func TestNewFastCDCRejectsInvalidSizes(t *testing.T) {
+	if _, err := NewFastCDC(1024, 3000, 8192); err == nil {
+		t.Errorf("Expected an error for a non power of two average")
+	}
+	if _, err := NewFastCDC(1024, 4096, 2*MaxChunkSize); err == nil {
+		t.Errorf("Expected an error for a maximum above MaxChunkSize")
+	}
+}
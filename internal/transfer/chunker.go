@@ -1,6 +1,7 @@
 package transfer
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -14,10 +15,36 @@ type Chunk struct {
 	Data  []byte
 }
 
+// ChunkInfo describes where a chunk lives in the original file without
+// carrying its data.
+type ChunkInfo struct {
+	Index  uint64
+	Offset int64
+	Size   int64
+	Hash   []byte
+}
+
+// Manifest lists the chunks a file is made of, in order.
+type Manifest struct {
+	Size   int64
+	Chunks []ChunkInfo
+}
+
+// ChunkHashes returns the hashes of the manifest's chunks in order.
+func (m *Manifest) ChunkHashes() [][]byte {
+	hashes := make([][]byte, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		hashes[i] = chunk.Hash
+	}
+	return hashes
+}
+
 type FileChunker struct {
 	File     io.Reader
 	Chunks   []*Chunk
+	Infos    []ChunkInfo
 	FileSize int64
+	Chunker  Chunker // defaults to fixed ChunkSize chunks
 }
 
 func NewFileChunker(file io.Reader, size int64) *FileChunker {
@@ -27,39 +54,130 @@ func NewFileChunker(file io.Reader, size int64) *FileChunker {
 	}
 }
 
+// Split reads the whole file and keeps every chunk's data in Chunks.
 func (fc *FileChunker) Split() error {
-	var index uint64 = 0
+	fc.Chunks = nil
+	return fc.readChunks(false, func(info ChunkInfo, data []byte) error {
+		fc.Chunks = append(fc.Chunks, &Chunk{
+			Index: info.Index,
+			Hash:  info.Hash,
+			Data:  data,
+		})
+		return nil
+	})
+}
+
+// Scan reads the file once and records only chunk metadata in Infos,
+// calling fn (if not nil) for each chunk as it is hashed. Memory use is
+// bounded by a single chunk regardless of file size; chunk data can be read
+// back later with GetChunk if File supports io.ReaderAt.
+func (fc *FileChunker) Scan(fn func(ChunkInfo) error) error {
+	fc.Chunks = nil
+	return fc.readChunks(true, func(info ChunkInfo, data []byte) error {
+		if fn != nil {
+			return fn(info)
+		}
+		return nil
+	})
+}
+
+// ScanData is like Scan but also passes each chunk's data to fn. The data
+// is only valid until fn returns.
+func (fc *FileChunker) ScanData(fn func(ChunkInfo, []byte) error) error {
+	fc.Chunks = nil
+	return fc.readChunks(true, fn)
+}
+
+// readChunks feeds fn every chunk of the file in order and records their
+// metadata in Infos. With reuse set, the data slice passed to fn is only
+// valid until fn returns.
+func (fc *FileChunker) readChunks(reuse bool, fn func(ChunkInfo, []byte) error) error {
+	chunker := fc.Chunker
+	if chunker == nil {
+		chunker = FixedChunker{Size: ChunkSize}
+	}
+
+	fc.Infos = nil
+	buf := make([]byte, chunker.MaxSize())
+	filled := 0
+	eof := false
+	var index uint64
+	var offset int64
 	for {
-		chunkData := make([]byte, ChunkSize)
-		n, err := fc.File.Read(chunkData)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("failed to read chunk: %w", err)
+		// Keep the window full so boundaries never depend on how the
+		// underlying reader splits its reads.
+		if !eof && filled < len(buf) {
+			n, err := io.ReadFull(fc.File, buf[filled:])
+			filled += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("failed to read chunk: %w", err)
+			}
 		}
-		if n == 0 {
+		if filled == 0 {
 			break
 		}
 
-		chunkData = chunkData[:n]
-		hash := sha256.Sum256(chunkData)
+		cut := chunker.Cut(buf[:filled])
+		if cut <= 0 || cut > filled {
+			return fmt.Errorf("chunker returned invalid boundary %d", cut)
+		}
+		chunkData := buf[:cut]
+		if !reuse {
+			chunkData = append([]byte(nil), chunkData...)
+		}
 
-		chunk := &Chunk{
-			Index: index,
-			Hash:  hash[:],
-			Data:  chunkData,
+		hash := sha256.Sum256(chunkData)
+		info := ChunkInfo{
+			Index:  index,
+			Offset: offset,
+			Size:   int64(cut),
+			Hash:   hash[:],
+		}
+		fc.Infos = append(fc.Infos, info)
+		if err := fn(info, chunkData); err != nil {
+			return err
 		}
-		fc.Chunks = append(fc.Chunks, chunk)
 		index++
+		offset += int64(cut)
 
-		if err == io.EOF {
-			break
-		}
+		filled = copy(buf, buf[cut:filled])
 	}
 	return nil
 }
 
+// GetChunk returns a chunk kept by Split or, after Scan, reads it from the
+// source file at its offset and checks it still matches the recorded hash.
 func (fc *FileChunker) GetChunk(index uint64) (*Chunk, error) {
-	if index >= uint64(len(fc.Chunks)) {
+	if fc.Chunks != nil {
+		if index >= uint64(len(fc.Chunks)) {
+			return nil, fmt.Errorf("chunk index out of range")
+		}
+		return fc.Chunks[index], nil
+	}
+
+	if index >= uint64(len(fc.Infos)) {
 		return nil, fmt.Errorf("chunk index out of range")
 	}
-	return fc.Chunks[index], nil
+	source, ok := fc.File.(io.ReaderAt)
+	if !ok {
+		return nil, fmt.Errorf("chunk source does not support random access")
+	}
+
+	info := fc.Infos[index]
+	data := make([]byte, info.Size)
+	if _, err := source.ReadAt(data, info.Offset); err != nil {
+		return nil, fmt.Errorf("failed to read chunk %d: %w", index, err)
+	}
+	hash := sha256.Sum256(data)
+	if !bytes.Equal(hash[:], info.Hash) {
+		return nil, fmt.Errorf("chunk %d changed since it was scanned", index)
+	}
+	return &Chunk{Index: info.Index, Hash: info.Hash, Data: data}, nil
+}
+
+// ChunkInfos returns the metadata of the chunks produced by Split or Scan.
+func (fc *FileChunker) ChunkInfos() []ChunkInfo {
+	return fc.Infos
 }
@@ -46,3 +46,56 @@ func TestFileChunkerGetChunk(t *testing.T) {
 		t.Errorf("Chunk data does not match original string")
 	}
 }
+
+func TestFileChunkerChunkInfos(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), ChunkSize+10)
+	chunker := NewFileChunker(bytes.NewReader(data), int64(len(data)))
+	if err := chunker.Split(); err != nil {
+		t.Fatalf("Failed to split file into chunks: %v", err)
+	}
+
+	infos := chunker.ChunkInfos()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 chunks, got %d", len(infos))
+	}
+	if infos[1].Offset != ChunkSize || infos[1].Size != 10 {
+		t.Errorf("Unexpected second chunk layout: offset %d, size %d", infos[1].Offset, infos[1].Size)
+	}
+	if !bytes.Equal(infos[1].Hash, chunker.Chunks[1].Hash) {
+		t.Errorf("Chunk info hash does not match chunk hash")
+	}
+}
+
+func TestFileChunkerScanReadsOnDemand(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), ChunkSize/4)
+	reader := bytes.NewReader(data)
+	chunker := NewFileChunker(reader, int64(len(data)))
+
+	var seen []uint64
+	err := chunker.Scan(func(info ChunkInfo) error {
+		seen = append(seen, info.Index)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan file: %v", err)
+	}
+	if len(seen) != 3 || len(chunker.Infos) != 3 {
+		t.Fatalf("Expected 3 chunks, got %d callbacks and %d infos", len(seen), len(chunker.Infos))
+	}
+	if chunker.Chunks != nil {
+		t.Errorf("Scan should not keep chunk data")
+	}
+
+	chunk, err := chunker.GetChunk(2)
+	if err != nil {
+		t.Fatalf("Failed to get chunk: %v", err)
+	}
+	if !bytes.Equal(chunk.Data, data[2*ChunkSize:]) {
+		t.Errorf("Chunk data does not match source at its offset")
+	}
+
+	data[2*ChunkSize] ^= 0xff
+	if _, err := chunker.GetChunk(2); err == nil {
+		t.Errorf("Expected an error for a chunk modified after scanning")
+	}
+}
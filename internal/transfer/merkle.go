@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Domain separation prefixes keep a leaf from being passed off as an
+// interior node and vice versa.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleTree is a binary hash tree over a file's chunk hashes. A level with
+// an odd number of nodes promotes its last node unchanged.
+type MerkleTree struct {
+	levels [][][]byte // levels[0] holds the leaves, the last level the root
+}
+
+func NewMerkleTree(chunkHashes [][]byte) *MerkleTree {
+	leaves := make([][]byte, len(chunkHashes))
+	for i, hash := range chunkHashes {
+		leaves[i] = hashLeaf(hash)
+	}
+
+	tree := &MerkleTree{levels: [][][]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, hashNode(level[i], level[i+1]))
+			}
+		}
+		tree.levels = append(tree.levels, next)
+		level = next
+	}
+	return tree
+}
+
+// MerkleRoot returns the root of the tree over chunkHashes.
+func MerkleRoot(chunkHashes [][]byte) []byte {
+	return NewMerkleTree(chunkHashes).Root()
+}
+
+// Root returns the root hash. The root of an empty tree is the SHA-256 of
+// no data.
+func (t *MerkleTree) Root() []byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	return top[0]
+}
+
+// Proof returns the sibling hashes needed to link the leaf at index to the
+// root, from the bottom of the tree up.
+func (t *MerkleTree) Proof(index uint64) ([][]byte, error) {
+	if index >= uint64(len(t.levels[0])) {
+		return nil, fmt.Errorf("leaf index out of range")
+	}
+
+	var proof [][]byte
+	i := index
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := i ^ 1
+		if sibling < uint64(len(level)) {
+			proof = append(proof, level[sibling])
+		}
+		i /= 2
+	}
+	return proof, nil
+}
+
+// VerifyProof checks that chunkHash is leaf index of a tree with count
+// leaves and the given root.
+func VerifyProof(root, chunkHash []byte, index uint64, count uint64, proof [][]byte) bool {
+	if index >= count {
+		return false
+	}
+
+	hash := hashLeaf(chunkHash)
+	i, width := index, count
+	for width > 1 {
+		if !(i == width-1 && width%2 == 1) {
+			if len(proof) == 0 {
+				return false
+			}
+			if i%2 == 0 {
+				hash = hashNode(hash, proof[0])
+			} else {
+				hash = hashNode(proof[0], hash)
+			}
+			proof = proof[1:]
+		}
+		i /= 2
+		width = (width + 1) / 2
+	}
+	return len(proof) == 0 && bytes.Equal(hash, root)
+}
+
+func hashLeaf(chunkHash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(chunkHash)
+	return h.Sum(nil)
+}
+
+func hashNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
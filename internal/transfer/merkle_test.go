@@ -0,0 +1,49 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func testChunkHashes(count int) [][]byte {
+	hashes := make([][]byte, count)
+	for i := range hashes {
+		sum := sha256.Sum256([]byte{byte(i)})
+		hashes[i] = sum[:]
+	}
+	return hashes
+}
+
+func TestMerkleProofs(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		hashes := testChunkHashes(count)
+		tree := NewMerkleTree(hashes)
+		root := tree.Root()
+
+		for i, hash := range hashes {
+			proof, err := tree.Proof(uint64(i))
+			if err != nil {
+				t.Fatalf("Failed to build proof for leaf %d of %d: %v", i, count, err)
+			}
+			if !VerifyProof(root, hash, uint64(i), uint64(count), proof) {
+				t.Errorf("Proof for leaf %d of %d did not verify", i, count)
+			}
+			if VerifyProof(root, hashes[(i+1)%count], uint64(i), uint64(count), proof) && count > 1 {
+				t.Errorf("Proof for leaf %d of %d verified the wrong chunk", i, count)
+			}
+		}
+	}
+}
+
+func TestMerkleRootDependsOnOrder(t *testing.T) {
+	hashes := testChunkHashes(4)
+	swapped := [][]byte{hashes[1], hashes[0], hashes[2], hashes[3]}
+
+	if bytes.Equal(MerkleRoot(hashes), MerkleRoot(swapped)) {
+		t.Errorf("Expected reordered chunks to change the root")
+	}
+	if len(MerkleRoot(nil)) != sha256.Size {
+		t.Errorf("Expected empty tree to have a root")
+	}
+}
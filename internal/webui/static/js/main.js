@@ -36,8 +36,10 @@ function updateUI(data) {
 function updatePeersList(peers) {
     const peersList = document.getElementById('peers-list');
     peersList.innerHTML = peers.map(peer => `
-        <div class="peer">
+        <div class="peer peer-${peer.state}">
             <span>${peer.address}</span>
+            <span>${peer.state}</span>
+            <span>${peer.rttMs} ms</span>
             <span>${peer.lastSeen}</span>
         </div>
     `).join('');
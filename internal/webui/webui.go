@@ -1,14 +1,19 @@
 package webui
 
 import (
+	"crypto/sha256"
 	"embed"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,11 +47,18 @@ func Start(port int) error {
 	http.HandleFunc("/api/updates", handleUpdates)
 	http.HandleFunc("/api/peers", handlePeers)
 	http.HandleFunc("/api/files", handleFiles)
+	http.HandleFunc("/api/files/", handleFileDownload)
 
 	// Serve static files
 	fileServer := http.FileServer(http.FS(content))
 	http.Handle("/static/", fileServer)
 
+	if nodeInstance != nil {
+		events, unsubscribe := nodeInstance.SubscribePeerEvents()
+		defer unsubscribe()
+		go forwardPeerEvents(events)
+	}
+
 	addr := fmt.Sprintf(":%d", port)
 	log.Printf("Starting Web UI on http://localhost%s", addr)
 	return http.ListenAndServe(addr, nil)
@@ -92,15 +104,52 @@ func handlePeers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	json.NewEncoder(w).Encode(peerList())
+}
+
+func peerList() []map[string]interface{} {
 	peers := nodeInstance.ListPeers()
 	peerList := make([]map[string]interface{}, 0, len(peers))
 	for _, peer := range peers {
 		peerList = append(peerList, map[string]interface{}{
 			"address":  peer.Address,
+			"id":       fmt.Sprintf("%x", peer.ID),
 			"lastSeen": peer.LastSeen,
+			"state":    peer.State,
+			"rttMs":    peer.RTT.Milliseconds(),
+			"failures": peer.Failures,
 		})
 	}
-	json.NewEncoder(w).Encode(peerList)
+	return peerList
+}
+
+// forwardPeerEvents pushes every peer state change, together with the
+// current peer list, to the clients waiting on /api/updates, until the
+// subscription ends.
+func forwardPeerEvents(events <-chan node.PeerEvent) {
+	for ev := range events {
+		update := map[string]interface{}{
+			"peerEvent": map[string]interface{}{
+				"address":  ev.Address,
+				"id":       fmt.Sprintf("%x", ev.ID),
+				"from":     ev.From,
+				"to":       ev.To,
+				"rttMs":    ev.RTT.Milliseconds(),
+				"failures": ev.Failures,
+				"time":     ev.Time,
+			},
+			"peers": peerList(),
+		}
+
+		updatesMu.RLock()
+		for _, ch := range updates {
+			select {
+			case ch <- update:
+			default:
+			}
+		}
+		updatesMu.RUnlock()
+	}
 }
 
 func handleFiles(w http.ResponseWriter, r *http.Request) {
@@ -146,6 +195,7 @@ func handleFiles(w http.ResponseWriter, r *http.Request) {
 	fileList := make([]map[string]interface{}, 0, len(files))
 	for _, file := range files {
 		fileList = append(fileList, map[string]interface{}{
+			"id":   fmt.Sprintf("%x", file.Hash),
 			"name": file.Name,
 			"size": file.Size,
 			"hash": fmt.Sprintf("%x", file.Hash),
@@ -153,3 +203,77 @@ func handleFiles(w http.ResponseWriter, r *http.Request) {
 	}
 	json.NewEncoder(w).Encode(fileList)
 }
+
+// handleFileDownload serves /api/files/<id>/download, where the ID is the
+// file's content hash. Files this node shares are served with range
+// support; others are fetched from the mesh and streamed to the browser
+// as the chunks arrive.
+func handleFileDownload(w http.ResponseWriter, r *http.Request) {
+	if nodeInstance == nil {
+		http.Error(w, "Node not initialized", http.StatusInternalServerError)
+		return
+	}
+	id, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/files/"), "/download")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hash, err := hex.DecodeString(id)
+	if err != nil || len(hash) != sha256.Size {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	// The ID is the content hash, so a matching ETag means the client
+	// already has the file and there is no need to look it up.
+	etag := `"` + hex.EncodeToString(hash) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	file, err := nodeInstance.OpenFile(r.Context(), hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("File not available: %v", err), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	name := file.Name
+	if name == "" {
+		name = id
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	if file.Local() {
+		http.ServeContent(w, r, name, file.Added, file)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		// The response is already under way; the short body tells the
+		// browser the download failed.
+		log.Printf("Download of %s failed: %v", id, err)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using the
+// weak comparison the header calls for.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package webui
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"meshfile/internal/dht"
+	"meshfile/internal/node"
+)
+
+func startNode(t *testing.T) (*node.Node, *dht.Node) {
+	n := node.NewNode(&node.Config{ListenAddr: "localhost:0"})
+	if err := n.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	t.Cleanup(n.Stop)
+	contact := &dht.Node{
+		ID:       n.GetDHT().LocalID,
+		Address:  fmt.Sprintf("localhost:%d", n.ListenAddr().(*net.TCPAddr).Port),
+		LastSeen: time.Now(),
+	}
+	return n, contact
+}
+
+func download(n *node.Node, id string, header http.Header) *httptest.ResponseRecorder {
+	SetNode(n)
+	r := httptest.NewRequest(http.MethodGet, "/api/files/"+id+"/download", nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	handleFileDownload(w, r)
+	return w
+}
+
+func TestHandleFileDownload(t *testing.T) {
+	defer SetNode(nil)
+	sharer, sharerContact := startNode(t)
+	fetcher, fetcherContact := startNode(t)
+	sharer.GetDHT().AddNode(fetcherContact)
+	fetcher.GetDHT().AddNode(sharerContact)
+
+	content := []byte("served to the browser by content hash")
+	path := filepath.Join(t.TempDir(), "shared.txt")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := sharer.AddFile(path); err != nil {
+		t.Fatalf("Failed to add file: %v", err)
+	}
+	hash := sharer.GetFileHash(path)
+	id := hex.EncodeToString(hash)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fetcher.GetDHT().GetProviders(hash)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the file to be announced")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if w := download(sharer, "not-hex", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad ID, got %d", w.Code)
+	}
+	if w := download(fetcher, strings.Repeat("00", 32), nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown hash, got %d", w.Code)
+	}
+
+	for name, n := range map[string]*node.Node{"local": sharer, "remote": fetcher} {
+		w := download(n, id, nil)
+		if w.Code != http.StatusOK || w.Body.String() != string(content) {
+			t.Errorf("Expected %s file to be served, got %d %q", name, w.Code, w.Body.String())
+		}
+		if etag := w.Header().Get("ETag"); etag != `"`+id+`"` {
+			t.Errorf("Expected %s file to carry its hash as ETag, got %q", name, etag)
+		}
+
+		w = download(n, id, http.Header{"If-None-Match": {`"` + id + `"`}})
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("Expected 304 for the %s file, got %d", name, w.Code)
+		}
+	}
+}
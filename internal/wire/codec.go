@@ -0,0 +1,93 @@
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrMalformed = errors.New("malformed payload")
+
+// Encoder appends uvarint-prefixed fields to a payload.
+type Encoder struct {
+	buf []byte
+}
+
+func (e *Encoder) Uint(v uint64) {
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *Encoder) Bytes(b []byte) {
+	e.Uint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *Encoder) Text(s string) {
+	e.Uint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *Encoder) Data() []byte {
+	return e.buf
+}
+
+// Decoder reads fields written by Encoder. After the first error every
+// read returns a zero value and Err reports ErrMalformed.
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+func NewDecoder(payload []byte) *Decoder {
+	return &Decoder{buf: payload}
+}
+
+func (d *Decoder) Uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrMalformed
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+// Bytes returns a copy of the next byte field.
+func (d *Decoder) Bytes() []byte {
+	size := d.Uint()
+	if d.err != nil {
+		return nil
+	}
+	if size > uint64(len(d.buf)) {
+		d.err = ErrMalformed
+		return nil
+	}
+	b := append([]byte(nil), d.buf[:size]...)
+	d.buf = d.buf[size:]
+	return b
+}
+
+func (d *Decoder) Text() string {
+	return string(d.Bytes())
+}
+
+// Count reads a list length, rejecting lengths that cannot fit in the rest
+// of the payload given at least minSize bytes per element.
+func (d *Decoder) Count(minSize int) int {
+	count := d.Uint()
+	if d.err == nil && count > uint64(len(d.buf)/max(minSize, 1)) {
+		d.err = ErrMalformed
+		return 0
+	}
+	return int(count)
+}
+
+// Err reports whether decoding failed or left trailing bytes.
+func (d *Decoder) Err() error {
+	if d.err == nil && len(d.buf) > 0 {
+		return ErrMalformed
+	}
+	return d.err
+}
@@ -0,0 +1,67 @@
+package wire
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Protocol versions this implementation speaks.
+const (
+	MinVersion = 1
+	Version    = 1
+)
+
+// Capabilities advertised in HELLO.
+const (
+	CapDHT       = "dht"       // PING, FIND_NODE
+	CapProviders = "providers" // STORE, FIND_VALUE
+	CapTransfer  = "transfer"  // GET_MANIFEST, GET_CHUNK, GET_FILE
+)
+
+// Hello opens every connection. The client offers the range of versions it
+// speaks; the server answers with a single chosen version.
+type Hello struct {
+	MinVersion   uint64
+	MaxVersion   uint64
+	Capabilities []string
+}
+
+func (h *Hello) Encode() []byte {
+	var e Encoder
+	e.Uint(h.MinVersion)
+	e.Uint(h.MaxVersion)
+	e.Uint(uint64(len(h.Capabilities)))
+	for _, c := range h.Capabilities {
+		e.Text(c)
+	}
+	return e.Data()
+}
+
+func DecodeHello(payload []byte) (*Hello, error) {
+	d := NewDecoder(payload)
+	h := &Hello{MinVersion: d.Uint(), MaxVersion: d.Uint()}
+	for i := d.Count(1); i > 0; i-- {
+		h.Capabilities = append(h.Capabilities, d.Text())
+	}
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("invalid HELLO: %w", err)
+	}
+	if h.MinVersion > h.MaxVersion {
+		return nil, fmt.Errorf("invalid HELLO: version range %d-%d", h.MinVersion, h.MaxVersion)
+	}
+	return h, nil
+}
+
+func (h *Hello) Supports(capability string) bool {
+	return slices.Contains(h.Capabilities, capability)
+}
+
+// Negotiate returns the highest version both hellos accept.
+func Negotiate(local, remote *Hello) (uint64, error) {
+	version := min(local.MaxVersion, remote.MaxVersion)
+	if version < max(local.MinVersion, remote.MinVersion) {
+		return 0, fmt.Errorf("no common protocol version: local %d-%d, remote %d-%d",
+			local.MinVersion, local.MaxVersion, remote.MinVersion, remote.MaxVersion)
+	}
+	return version, nil
+}
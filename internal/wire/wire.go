@@ -0,0 +1,114 @@
+// Package wire implements the framed binary protocol spoken between peers.
+//
+// Every message is a frame:
+//
+//	type (1 byte) | request ID (4 bytes) | payload length (4 bytes) | payload
+//
+// with integers in big-endian order. A response carries the request ID of
+// the request it answers. Payloads are built with Encoder and Decoder.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	HeaderSize     = 9
+	MaxPayloadSize = 32 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame exceeds maximum payload size")
+
+type Type uint8
+
+const (
+	TypeHello Type = iota + 1
+	TypeError
+	TypePing
+	TypePong
+	TypeFindNode
+	TypeNodes
+	TypeStore
+	TypeStored
+	TypeFindValue
+	TypeValue
+	TypeGetManifest
+	TypeGetChunk
+	TypeData
+	TypeGetFile
+	TypeFile
+)
+
+var typeNames = map[Type]string{
+	TypeHello:       "HELLO",
+	TypeError:       "ERROR",
+	TypePing:        "PING",
+	TypePong:        "PONG",
+	TypeFindNode:    "FIND_NODE",
+	TypeNodes:       "NODES",
+	TypeStore:       "STORE",
+	TypeStored:      "STORED",
+	TypeFindValue:   "FIND_VALUE",
+	TypeValue:       "VALUE",
+	TypeGetManifest: "GET_MANIFEST",
+	TypeGetChunk:    "GET_CHUNK",
+	TypeData:        "DATA",
+	TypeGetFile:     "GET_FILE",
+	TypeFile:        "FILE",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Type(%d)", uint8(t))
+}
+
+type Frame struct {
+	Type      Type
+	RequestID uint32
+	Payload   []byte
+}
+
+func WriteFrame(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MaxPayloadSize {
+		return ErrFrameTooLarge
+	}
+	var header [HeaderSize]byte
+	header[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(header[1:5], f.RequestID)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(f.Payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+// ReadFrame reads the next frame. Oversized frames are rejected before the
+// payload is read, so the stream cannot be used afterwards.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[5:9])
+	if size > MaxPayloadSize {
+		return nil, ErrFrameTooLarge
+	}
+	f := &Frame{
+		Type:      Type(header[0]),
+		RequestID: binary.BigEndian.Uint32(header[1:5]),
+		Payload:   make([]byte, size),
+	}
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
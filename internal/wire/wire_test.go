@@ -0,0 +1,111 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	frames := []*Frame{
+		{Type: TypePing, RequestID: 1, Payload: []byte("hello")},
+		{Type: TypeData, RequestID: 2, Payload: []byte{0, '\n', 0xff}},
+		{Type: TypeStored, RequestID: 3},
+	}
+	for _, f := range frames {
+		if err := WriteFrame(&buf, f); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+	}
+
+	for _, want := range frames {
+		got, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		if got.Type != want.Type || got.RequestID != want.RequestID || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("Expected %+v, got %+v", want, got)
+		}
+	}
+	if _, err := ReadFrame(&buf); err != io.EOF {
+		t.Errorf("Expected EOF after last frame, got %v", err)
+	}
+}
+
+func TestReadFrameRejectsOversizedFrames(t *testing.T) {
+	header := make([]byte, HeaderSize)
+	header[0] = byte(TypeData)
+	binary.BigEndian.PutUint32(header[5:], MaxPayloadSize+1)
+
+	if _, err := ReadFrame(bytes.NewReader(header)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestReadFrameDetectsTruncation(t *testing.T) {
+	var buf bytes.Buffer
+	WriteFrame(&buf, &Frame{Type: TypeData, Payload: []byte("truncated")})
+
+	data := buf.Bytes()[:buf.Len()-1]
+	if _, err := ReadFrame(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	var e Encoder
+	e.Bytes([]byte("id"))
+	e.Text("localhost:3000")
+	e.Uint(42)
+
+	d := NewDecoder(e.Data())
+	if b := d.Bytes(); string(b) != "id" {
+		t.Errorf("Expected id, got %q", b)
+	}
+	if s := d.Text(); s != "localhost:3000" {
+		t.Errorf("Expected address, got %q", s)
+	}
+	if v := d.Uint(); v != 42 {
+		t.Errorf("Expected 42, got %d", v)
+	}
+	if err := d.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// A length prefix pointing past the end of the payload.
+	d = NewDecoder([]byte{10, 'x'})
+	d.Bytes()
+	if d.Err() != ErrMalformed {
+		t.Errorf("Expected ErrMalformed for short field")
+	}
+
+	d = NewDecoder(append(e.Data(), 0))
+	d.Bytes()
+	d.Text()
+	d.Uint()
+	if d.Err() != ErrMalformed {
+		t.Errorf("Expected ErrMalformed for trailing bytes")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	local := &Hello{MinVersion: 1, MaxVersion: 3, Capabilities: []string{CapDHT}}
+
+	hello, err := DecodeHello((&Hello{MinVersion: 2, MaxVersion: 5, Capabilities: []string{CapDHT, CapTransfer}}).Encode())
+	if err != nil {
+		t.Fatalf("Failed to decode HELLO: %v", err)
+	}
+	if !hello.Supports(CapTransfer) || hello.Supports(CapProviders) {
+		t.Errorf("Capabilities not preserved: %v", hello.Capabilities)
+	}
+	if version, err := Negotiate(local, hello); err != nil || version != 3 {
+		t.Errorf("Expected version 3, got %d (%v)", version, err)
+	}
+
+	if _, err := Negotiate(local, &Hello{MinVersion: 4, MaxVersion: 4}); err == nil {
+		t.Error("Expected negotiation to fail without a common version")
+	}
+}
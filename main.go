@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"meshfile/internal/discovery"
 	"meshfile/internal/node"
+	"meshfile/internal/transfer"
 	"meshfile/internal/webui"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 var nodeInstance *node.Node
@@ -12,11 +19,39 @@ var nodeInstance *node.Node
 func main() {
 	port := flag.Int("port", 3000, "Port to listen on")
 	webUIPort := flag.Int("webui", 8080, "Web UI port")
+	filePort := flag.Int("files", 8081, "Port for serving shared files over HTTP")
+	listen := flag.String("listen", "", "Address to bind the DHT service to (default :<port>)")
+	advertise := flag.String("advertise", "", "Address other nodes should use to reach this node (default: learned from peers)")
+	bootstrap := flag.String("bootstrap", "", "Comma-separated list of bootstrap peers (host:port)")
+	chunking := flag.String("chunker", "fixed", "Chunking for shared files: fixed or cdc")
+	identity := flag.String("identity", "", "Path to the node identity key (created if missing; default <data-dir>/identity.pem)")
+	dataDir := flag.String("data-dir", "", "Directory for shared data, the file catalog and the peer table (default: temporary)")
+	lan := flag.Bool("lan", true, "Find other nodes on the local network by multicast")
+	lanGroup := flag.String("lan-group", discovery.DefaultGroup, "Multicast group for LAN discovery")
+	lanInterface := flag.String("lan-interface", "", "Network interface for LAN discovery")
 	flag.Parse()
 
+	var chunker transfer.Chunker
+	switch *chunking {
+	case "fixed":
+	case "cdc":
+		chunker = transfer.DefaultFastCDC()
+	default:
+		log.Fatalf("Unknown chunker %q", *chunking)
+	}
+
 	config := &node.Config{
-		Port:      *port,
-		WebUIPort: *webUIPort,
+		Port:           *port,
+		ListenAddr:     *listen,
+		AdvertiseAddr:  *advertise,
+		FileServerPort: *filePort,
+		BootstrapPeers: splitList(*bootstrap),
+		Chunker:        chunker,
+		IdentityPath:   *identity,
+		DataDir:        *dataDir,
+		LANDiscovery:   *lan,
+		LANGroup:       *lanGroup,
+		LANInterface:   *lanInterface,
 	}
 
 	nodeInstance = node.NewNode(config)
@@ -28,9 +63,23 @@ func main() {
 		}
 	}()
 
-	if err := nodeInstance.Start(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := nodeInstance.Start(ctx); err != nil {
 		log.Fatal(err)
 	}
 
-	select {}
+	<-ctx.Done()
+	nodeInstance.Stop()
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }